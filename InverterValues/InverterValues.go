@@ -1,50 +1,54 @@
 package InverterValues
 
 import (
-	"strconv"
 	"sync"
 )
 
+// Status flags reported by the inverters
+type Flags struct {
+	OnRelay1       bool `json:"onRelay1"`
+	OnRelay2       bool `json:"onRelay2"`
+	OnRelay1Slave1 bool `json:"onRelay1Slave1"`
+	OnRelay2Slave1 bool `json:"onRelay2Slave1"`
+	OnRelay1Slave2 bool `json:"onRelay1Slave2"`
+	OnRelay2Slave2 bool `json:"onRelay2Slave2"`
+	GnRun          bool `json:"gnRun"`
+	GnRunSlave1    bool `json:"gnRunSlave1"`
+	GnRunSlave2    bool `json:"gnRunSlave2"`
+	AutoGn         bool `json:"autoGn"`
+	AutoLodExt     bool `json:"autoLodExt"`
+	AutoLodSoc     bool `json:"autoLodSoc"`
+	Tm1            bool `json:"tm1"`
+	Tm2            bool `json:"tm2"`
+	ExtPwrDer      bool `json:"extPwrDer"`
+	ExtVfOk        bool `json:"extVfOk"`
+	GdOn           bool `json:"gdOn"`
+	Errror         bool `json:"error"`
+	Run            bool `json:"run"`
+	BatFan         bool `json:"batFan"`
+	AcdCir         bool `json:"acdCir"`
+	MccBatFan      bool `json:"mccBatFan"`
+	MccAutoLod     bool `json:"mccAutoLod"`
+	Chp            bool `json:"chp"`
+	ChpAdd         bool `json:"chpAdd"`
+	SiComRemote    bool `json:"siComRemote"`
+	OverLoad       bool `json:"overLoad"`
+	ExtSrcConn     bool `json:"extSrcConn"`
+	Silent         bool `json:"silent"`
+	Current        bool `json:"current"`
+	FeedSelfC      bool `json:"feedSelfC"`
+	Esave          bool `json:"esave"`
+}
+
 type InverterValues struct {
-	volts          float32
-	amps           float32
-	soc            float32
-	vsetpoint      float32
-	frequency      float64
-	iMax           float32
-	OnRelay1       bool
-	OnRelay2       bool
-	OnRelay1Slave1 bool
-	OnRelay2Slave1 bool
-	OnRelay1Slave2 bool
-	OnRelay2Slave2 bool
-	GnRun          bool
-	GnRunSlave1    bool
-	GnRunSlave2    bool
-	AutoGn         bool
-	AutoLodExt     bool
-	AutoLodSoc     bool
-	Tm1            bool
-	Tm2            bool
-	ExtPwrDer      bool
-	ExtVfOk        bool
-	GdOn           bool
-	Errror         bool
-	Run            bool
-	BatFan         bool
-	AcdCir         bool
-	MccBatFan      bool
-	MccAutoLod     bool
-	Chp            bool
-	ChpAdd         bool
-	SiComRemote    bool
-	OverLoad       bool
-	ExtSrcConn     bool
-	Silent         bool
-	Current        bool
-	FeedSelfC      bool
-	Esave          bool
-	mu             sync.Mutex
+	volts     float32
+	amps      float32
+	soc       float32
+	vsetpoint float32
+	frequency float64
+	iMax      float32
+	Flags
+	mu sync.Mutex
 }
 
 func (i *InverterValues) GetVolts() float32 {
@@ -80,73 +84,10 @@ func (i *InverterValues) GetIMax() float32 {
 	return i.iMax
 }
 
-func (i *InverterValues) GetFlags() string {
+func (i *InverterValues) GetFlags() Flags {
 	i.mu.Lock()
 	defer i.mu.Unlock()
-	sFlags := `                "onRelay1":"` + strconv.FormatBool(i.OnRelay1) + `",
-`
-	sFlags += `                "onRelay2":"` + strconv.FormatBool(i.OnRelay2) + `",
-`
-	sFlags += `                "onRelay1Slave1":"` + strconv.FormatBool(i.OnRelay1Slave1) + `",
-`
-	sFlags += `                "onRelay2Slave1":"` + strconv.FormatBool(i.OnRelay1Slave2) + `",
-`
-	sFlags += `                "onRelay1Slave2":"` + strconv.FormatBool(i.OnRelay2Slave1) + `",
-`
-	sFlags += `                "onRelay2Slave2":"` + strconv.FormatBool(i.OnRelay2Slave2) + `",
-`
-	sFlags += `                "gnRun":"` + strconv.FormatBool(i.GnRun) + `",
-`
-	sFlags += `                "gnRunSlave1":"` + strconv.FormatBool(i.GnRunSlave1) + `",
-`
-	sFlags += `                "gnRunSlave2":"` + strconv.FormatBool(i.GnRunSlave2) + `",
-`
-	sFlags += `                "autoGn":"` + strconv.FormatBool(i.AutoGn) + `",
-`
-	sFlags += `                "autoLodExt":"` + strconv.FormatBool(i.AutoLodExt) + `",
-`
-	sFlags += `                "autoLodSoc":"` + strconv.FormatBool(i.AutoLodSoc) + `",
-`
-	sFlags += `                "tm1":"` + strconv.FormatBool(i.Tm1) + `",
-`
-	sFlags += `                "tm2":"` + strconv.FormatBool(i.Tm2) + `",
-`
-	sFlags += `                "extPwrDer":"` + strconv.FormatBool(i.ExtPwrDer) + `",
-`
-	sFlags += `                "extVfOk":"` + strconv.FormatBool(i.ExtVfOk) + `",
-`
-	sFlags += `                "gdOn":"` + strconv.FormatBool(i.GdOn) + `",
-`
-	sFlags += `                "errror":"` + strconv.FormatBool(i.Errror) + `",
-`
-	sFlags += `                "run":"` + strconv.FormatBool(i.Run) + `",
-`
-	sFlags += `                "batFan":"` + strconv.FormatBool(i.BatFan) + `",
-`
-	sFlags += `                "acdCir":"` + strconv.FormatBool(i.AcdCir) + `",
-`
-	sFlags += `                "mccBatFan":"` + strconv.FormatBool(i.MccBatFan) + `",
-`
-	sFlags += `                "mccAutoLod":"` + strconv.FormatBool(i.MccAutoLod) + `",
-`
-	sFlags += `                "chp":"` + strconv.FormatBool(i.Chp) + `",
-`
-	sFlags += `                "chpAdd":"` + strconv.FormatBool(i.ChpAdd) + `",
-`
-	sFlags += `                "siComRemote":"` + strconv.FormatBool(i.SiComRemote) + `",
-`
-	sFlags += `                "overLoad":"` + strconv.FormatBool(i.OverLoad) + `",
-`
-	sFlags += `                "extSrcConn":"` + strconv.FormatBool(i.ExtSrcConn) + `",
-`
-	sFlags += `                "silent":"` + strconv.FormatBool(i.Silent) + `",
-`
-	sFlags += `                "current":"` + strconv.FormatBool(i.Current) + `",
-`
-	sFlags += `                "feedSelfC":"` + strconv.FormatBool(i.FeedSelfC) + `",
-`
-	sFlags += `                "esave":"` + strconv.FormatBool(i.Esave) + `"`
-	return sFlags
+	return i.Flags
 }
 
 func (i *InverterValues) SetVolts(volts float32) {
@@ -7,6 +7,9 @@ import (
 
 const minAmps = 5.0
 
+// Used until the slaves tell us their ratings
+const DefaultSystemMax = 48.0
+
 type Params struct {
 	current    float32
 	maxAmps    float32
@@ -42,13 +45,13 @@ func (p *Params) SetCurrent(i float32) {
 }
 
 func (p *Params) SetMaxAmps(i float32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	if i > p.systemMax {
-		i = 48
+		i = p.systemMax
 	} else if i < 0 {
 		i = 0
 	}
-	p.mu.Lock()
-	defer p.mu.Unlock()
 	p.maxAmps = i
 	p.lastChange = time.Now()
 }
@@ -58,7 +61,23 @@ func (p *Params) Reset() {
 	p.mu.Unlock()
 	p.maxAmps = 10.0
 	p.lastChange = time.Now()
-	p.systemMax = 48.0
+	p.systemMax = DefaultSystemMax
+}
+
+func (p *Params) GetSystemMax() float32 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.systemMax
+}
+
+// Set the most current we can hand out across all the slaves. Pull the available current down if it is now too high.
+func (p *Params) SetSystemMax(i float32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.systemMax = i
+	if p.maxAmps > p.systemMax {
+		p.maxAmps = p.systemMax
+	}
 }
 
 /// Change the charging current. Return true if it was changed or false if we
@@ -7,9 +7,18 @@ import (
 	"CanMessages/CAN_307"
 	"TeslaChargeControl/InverterValues"
 	"TeslaChargeControl/Params"
+	"TeslaChargeControl/chargeAllocator"
+	"TeslaChargeControl/chargeOverride"
+	"TeslaChargeControl/config"
+	"TeslaChargeControl/dashboard"
+	"TeslaChargeControl/diverters"
+	"TeslaChargeControl/eventStream"
 	"TeslaChargeControl/heaterSetting"
+	"TeslaChargeControl/pumpControl"
+	"TeslaChargeControl/twcCapture"
 	"TeslaChargeControl/twcMessage"
 	"TeslaChargeControl/twcSlave"
+	"context"
 	"database/sql"
 	"flag"
 	"fmt"
@@ -17,10 +26,19 @@ import (
 	"github.com/goburrow/serial"
 	"github.com/golang/glog"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"io"
 	"log"
 	"log/syslog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -33,7 +51,10 @@ var (
 	stopbits         int
 	parity           string
 	listenMode       bool
+	followMode       bool // Just decode the traffic between an existing master and its slaves. Never send anything.
+	followedMaster   uint // Address of the master we are following
 	apiPort          uint
+	webServer        *http.Server
 	databaseServer   string
 	databasePort     string
 	databaseName     string
@@ -42,14 +63,48 @@ var (
 	masterAddress    uint
 	port             serial.Port
 	TeslaParameters  Params.Params
-	Heater           *heaterSetting.HeaterSetting
+	Heater           *heaterSetting.HeaterSetting // The original hot water tank
+	Diverters        *diverters.Registry          // Every load surplus power can go to including the hot water tank
+	SolarPump        *pumpControl.SolarPump       // nil if there is no solar collector pump
+	Fan              *pumpControl.Fan             // nil if there is no cooling fan
+	Allocator        *chargeAllocator.ChargeAllocator
+	Overrides        *chargeOverride.Overrides
+	Events           *eventStream.Hub // Status changes pushed to the web clients
+	Config           *config.Config
+	configFile       string
+	captureFile      string
+	capture          *twcCapture.Capture // nil unless capturing
+	gpioDriver       string
+	gpioChip         string
+	replayFile       string
+	stateDir         string
 	iValues          InverterValues.InverterValues
-	slaves           []twcSlave.Slave
+	slaves           []twcSlave.Slave // Only used by the RS485 loop. Everything else uses getSlaves()
+	slavesSnapshot   []twcSlave.Slave // Copy of slaves for the other goroutines
+	slavesMu         sync.Mutex
 	pDB              *sql.DB
 
 //	hotTankTemp			int16
 )
 
+// Publish a copy of the slaves for the power loop, web server, metrics and database logger. Called by the RS485 loop
+// each time round.
+func publishSlaves() {
+	snapshot := make([]twcSlave.Slave, len(slaves))
+	copy(snapshot, slaves)
+	slavesMu.Lock()
+	defer slavesMu.Unlock()
+	slavesSnapshot = snapshot
+}
+
+// Return the slaves as they were when the RS485 loop last published them. These are copies so they must not be
+// changed.
+func getSlaves() []twcSlave.Slave {
+	slavesMu.Lock()
+	defer slavesMu.Unlock()
+	return slavesSnapshot
+}
+
 func findSlave(slaves []twcSlave.Slave, address uint) int {
 	for i, s := range slaves {
 		if s.GetAddress() == address {
@@ -59,36 +114,122 @@ func findSlave(slaves []twcSlave.Slave, address uint) int {
 	return -1
 }
 
+// Create a slave and apply any limits configured for it
+func newSlave(address uint) twcSlave.Slave {
+	s := twcSlave.New(address, listenMode, port)
+	if charger, found := Config.GetCharger(address); found {
+		s.SetLimits(int(charger.MinAmps*100), int(charger.MaxAmps*100))
+		glog.Infof("Slave %04x limited to %0.2fA - %0.2fA", address, charger.MinAmps, charger.MaxAmps)
+	}
+	return s
+}
+
 func logData(msg twcMessage.TwcMessage, slaves *[]twcSlave.Slave) {
 
 	i := findSlave(*slaves, msg.GetFromAddress())
 	if i >= 0 {
 		(*slaves)[i].UpdateValues(&msg)
 	} else {
-		s := twcSlave.New(msg.GetFromAddress(), listenMode, port)
+		s := newSlave(msg.GetFromAddress())
 		s.UpdateValues(&msg)
 		*slaves = append(*slaves, s)
 	}
 }
 
-// If we don't already have the slave, add it to the list
+// If we don't already have the slave, add it to the list. Either way record its rating and ask who it is.
 func processSlaveLinkReady(msg twcMessage.TwcMessage, slaves *[]twcSlave.Slave) {
 	i := findSlave(*slaves, msg.GetFromAddress())
 	if i < 0 {
-		s := twcSlave.New(msg.GetFromAddress(), listenMode, port)
-		s.UpdateValues(&msg)
+		s := newSlave(msg.GetFromAddress())
+		s.UpdateLinkReady(&msg)
 		*slaves = append(*slaves, s)
-		glog.Info("Slave added [%04x]", msg.GetFromAddress())
+		glog.Infof("Slave added [%04x] protocol version %d rated at %0.2fA", msg.GetFromAddress(), msg.GetProtocolVersion(), float32(msg.GetMaxAmps())/100)
+	} else {
+		(*slaves)[i].UpdateLinkReady(&msg)
+	}
+	updateSystemMax(*slaves)
+}
+
+func processSlaveSerialNumber(msg twcMessage.TwcMessage, slaves *[]twcSlave.Slave) {
+	i := findSlave(*slaves, msg.GetFromAddress())
+	if i >= 0 {
+		(*slaves)[i].UpdateSerialNumber(&msg)
+		glog.Infof("Slave %04x serial number %s", msg.GetFromAddress(), msg.GetSerialNumber())
+	}
+}
+
+func processSlaveFirmwareVersion(msg twcMessage.TwcMessage, slaves *[]twcSlave.Slave) {
+	i := findSlave(*slaves, msg.GetFromAddress())
+	if i >= 0 {
+		(*slaves)[i].UpdateFirmwareVersion(&msg)
+		glog.Infof("Slave %04x firmware version %s", msg.GetFromAddress(), msg.GetFirmwareVersion())
+	}
+}
+
+// The most we can hand out is the total of the slave limits. Use the default until we know the limit for every slave.
+func updateSystemMax(slaves []twcSlave.Slave) {
+	total := 0
+	for _, s := range slaves {
+		if s.GetCurrentLimit() == 0 {
+			total = 0
+			break
+		}
+		total += s.GetCurrentLimit()
+	}
+	if total > 0 {
+		TeslaParameters.SetSystemMax(float32(total) / 100)
+	} else {
+		TeslaParameters.SetSystemMax(Params.DefaultSystemMax)
+	}
+}
+
+// Record the meter readings from an energy report. Ignore it if we don't know the slave yet.
+func processSlaveEnergy(msg twcMessage.TwcMessage, slaves *[]twcSlave.Slave) {
+	i := findSlave(*slaves, msg.GetFromAddress())
+	if i >= 0 {
+		(*slaves)[i].UpdateEnergy(&msg)
+	}
+}
+
+// Add part of the VIN to the slave it came from and log the car once we have the whole VIN
+func processSlaveVIN(msg twcMessage.TwcMessage, slaves *[]twcSlave.Slave) {
+	i := findSlave(*slaves, msg.GetFromAddress())
+	if i >= 0 && (*slaves)[i].UpdateVIN(&msg) {
+		glog.Infof("Slave %04x is charging car VIN %s", msg.GetFromAddress(), (*slaves)[i].GetVIN())
+		glog.Flush()
+	}
+}
+
+// Record the current a real master has allowed one of its slaves. Only used in follow mode.
+func processMasterHeartbeat(msg twcMessage.TwcMessage, slaves *[]twcSlave.Slave) {
+	processMasterLinkReady(msg)
+	i := findSlave(*slaves, msg.GetToAddress())
+	if i < 0 {
+		*slaves = append(*slaves, newSlave(msg.GetToAddress()))
+		i = len(*slaves) - 1
+	}
+	(*slaves)[i].UpdateFromMaster(&msg)
+}
+
+// Note the address of the master we are following
+func processMasterLinkReady(msg twcMessage.TwcMessage) {
+	if followedMaster != msg.GetFromAddress() {
+		followedMaster = msg.GetFromAddress()
+		glog.Infof("Following master %04x protocol version %d", followedMaster, msg.GetProtocolVersion())
+		glog.Flush()
 	}
 }
 
 func checkSlaveTimeouts(slaves []twcSlave.Slave) []twcSlave.Slave {
 	for i, s := range slaves {
 		if s.TimeSinceLastHeartbeat() > (10 * time.Second) {
+			atomic.AddUint64(&slaveTimeouts, 1)
 			glog.Infof("=======> Slave %04x has gone away! Time span = %d > 10 seconds (%d). <=======\n", s.GetAddress(), s.TimeSinceLastHeartbeat(), time.Second*10)
 			glog.Flush()
 			slaves[i] = slaves[len(slaves)-1]
-			return slaves[:len(slaves)-1]
+			slaves = slaves[:len(slaves)-1]
+			updateSystemMax(slaves)
+			return slaves
 		}
 	}
 	return slaves
@@ -104,95 +245,209 @@ func sendHearbeatsToSlaves(slaves []twcSlave.Slave, masterAddress uint) {
 	}
 }
 
+// Ask each slave for its meter readings when they are due
+func requestEnergyFromSlaves(slaves []twcSlave.Slave, masterAddress uint) {
+	for i := range slaves {
+		slaves[i].RequestEnergy(masterAddress)
+	}
+}
+
+// Ask newly linked slaves for their serial number and firmware version
+func requestIdentityFromSlaves(slaves []twcSlave.Slave, masterAddress uint) {
+	for i := range slaves {
+		slaves[i].RequestIdentity(masterAddress)
+	}
+}
+
+// Ask slaves with a newly connected car for its VIN
+func requestVINFromSlaves(slaves []twcSlave.Slave, masterAddress uint) {
+	for i := range slaves {
+		slaves[i].RequestVIN(masterAddress)
+	}
+}
+
+// Share the available current out amongst the slaves using the selected allocation policy after applying any
+// manual overrides. Nobody charges while the generator runs whatever the overrides say.
 func divideMaxAmpsAmongstSlaves(slaves []twcSlave.Slave, maxAmps int) {
-	activeCars := 0
+	shared, fixed := Overrides.Apply(maxAmps, int(TeslaParameters.GetSystemMax()*100), iValues.AutoGn)
+	Allocator.Allocate(slaves, shared, fixed)
+}
 
-	// Find out how many cars are waiting to charge, actively charging or starting to charge
-	for _, s := range slaves {
-		// Count how many cars are trying to charge.
-		if s.RequestCharge() {
-			activeCars++
-		}
+func setUpWebSite() {
+	router := mux.NewRouter().StrictSlash(true)
+	router.HandleFunc("/", getValues).Methods("GET")
+	router.HandleFunc("/disableHeater", disableHeater).Methods("POST")
+	router.HandleFunc("/enableHeater", enableHeater).Methods("POST")
+	router.HandleFunc("/disableDiverter/{name}", disableDiverter).Methods("POST")
+	router.HandleFunc("/enableDiverter/{name}", enableDiverter).Methods("POST")
+	router.HandleFunc("/allocationPolicy/{policy}", setAllocationPolicy).Methods("POST")
+	router.HandleFunc("/slavePriority/{address}/{priority}", setSlavePriority).Methods("POST")
+	setUpAPIv1(router)
+	router.Handle("/metrics", promhttp.Handler()).Methods("GET")
+	router.Handle("/dashboard", http.RedirectHandler("/dashboard/", http.StatusMovedPermanently)).Methods("GET")
+	router.PathPrefix("/dashboard/").Handler(http.StripPrefix("/dashboard/", dashboard.Handler())).Methods("GET")
+
+	api := Config.API
+	if api.Port == 0 {
+		api.Port = int(apiPort)
 	}
-	// If there is at least one car then divide the current between them equally
-	if activeCars > 0 {
-		maxAmps = maxAmps / activeCars
+	access, err := newAccessControl(api, filepath.Join(stateDir, "audit.log"))
+	if err != nil {
+		glog.Fatalf("Bad api configuration - %s - Sorry, I am giving up.", err)
 	}
-	// If we end up with less than 5 amps for each car, stop charging until we have more available
-	if maxAmps < 500 {
-		maxAmps = 0
+	if (api.CertFile == "") != (api.KeyFile == "") {
+		glog.Fatalf("The api configuration needs both certFile and keyFile to serve HTTPS - Sorry, I am giving up.")
 	}
-	// Share out the current amongst the cars waiting to charge or actively charging
-	for i, s := range slaves {
-		if s.RequestCharge() {
-			slaves[i].SetCurrent(maxAmps)
+	webServer = &http.Server{Handler: access.handler(router), ReadHeaderTimeout: 10 * time.Second}
+	webServer.RegisterOnShutdown(Events.Close)
+	if api.UnixSocket != "" {
+		// Clear out the socket left behind if we didn't shut down cleanly last time
+		_ = os.Remove(api.UnixSocket)
+		listener, err := net.Listen("unix", api.UnixSocket)
+		if err != nil {
+			glog.Fatalf("Cannot listen on %s - %s - Sorry, I am giving up.", api.UnixSocket, err)
 		}
+		// Only our own user and group may connect whatever the umask
+		err = os.Chmod(api.UnixSocket, 0660)
+		if err != nil {
+			glog.Fatalf("Cannot set the permissions of %s - %s - Sorry, I am giving up.", api.UnixSocket, err)
+		}
+		glog.Infof("API listening on %s", api.UnixSocket)
+		go serveAPI(listener, "", "")
 	}
+	if !api.NoTCP {
+		address := net.JoinHostPort(api.Address, strconv.Itoa(api.Port))
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			glog.Fatalf("Cannot listen on %s - %s - Sorry, I am giving up.", address, err)
+		}
+		if api.UseTLS() {
+			glog.Infof("API listening on https://%s", address)
+			go serveAPI(listener, api.CertFile, api.KeyFile)
+		} else {
+			glog.Infof("API listening on http://%s", address)
+			go serveAPI(listener, "", "")
+		}
+	}
+	glog.Flush()
 }
 
-func setUpWebSite() {
-	router := mux.NewRouter().StrictSlash(true)
-	router.HandleFunc("/", getValues).Methods("GET")
-	router.HandleFunc("/disableHeater", disableHeater).Methods("GET")
-	router.HandleFunc("/enableHeater", enableHeater).Methods("GET")
-	log.Fatal(http.ListenAndServe(":8080", router))
+// Serve the API on the listener until the server is shut down. Serves HTTPS if a certificate is given.
+func serveAPI(listener net.Listener, certFile string, keyFile string) {
+	var err error
+	if certFile != "" {
+		err = webServer.ServeTLS(listener, certFile, keyFile)
+	} else {
+		err = webServer.Serve(listener)
+	}
+	if err != http.ErrServerClosed {
+		glog.Fatalf("The API server on %s failed - %s - Sorry, I am giving up.", listener.Addr(), err)
+	}
+}
+
+// How long open requests get to finish when we shut down
+const shutdownTimeout = 5 * time.Second
+
+func shutdownOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	glog.Infof("Shutting down on %s", sig)
+	shutdown()
+	os.Exit(0)
+}
+
+// Stop the API server letting open requests finish, switch off everything we drive and save anything we want to keep
+// across the restart
+func shutdown() {
+	if webServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		err := webServer.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			glog.Errorf("The API server did not shut down cleanly - %s", err)
+		}
+		if Config.API.UnixSocket != "" {
+			_ = os.Remove(Config.API.UnixSocket)
+		}
+	}
+	// Don't leave the elements, pumps or fan running while nothing is watching them
+	Diverters.SwitchOff()
+	if SolarPump != nil {
+		SolarPump.Stop()
+	}
+	if Fan != nil {
+		Fan.Stop()
+	}
+	for _, d := range Diverters.GetAll() {
+		d.Heater.SaveElementStats()
+	}
+	// The last burst is only written when the next one starts or the capture is closed
+	if capture != nil {
+		err := capture.Close()
+		if err != nil {
+			glog.Errorf("Failed to close the capture file %s - %s", captureFile, err)
+		}
+	}
+	glog.Flush()
 }
 
 func enableHeater(w http.ResponseWriter, r *http.Request) {
 
-	Heater.SetEnabled(true)
+	Diverters.SetEnabled(true)
 	getValues(w, r)
 }
 
 func disableHeater(w http.ResponseWriter, r *http.Request) {
 
-	Heater.SetEnabled(false)
-	Heater.SetHeater(0)
+	Diverters.SetEnabled(false)
+	Diverters.AllOff()
 	getValues(w, r)
 }
 
-func getValues(w http.ResponseWriter, _ *http.Request) {
-	_, fMaxAmps := TeslaParameters.GetValues()
-	var sPump string
+func enableDiverter(w http.ResponseWriter, r *http.Request) {
+	setDiverterEnabled(w, r, true)
+}
+
+func disableDiverter(w http.ResponseWriter, r *http.Request) {
+	setDiverterEnabled(w, r, false)
+}
 
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	if Heater.GetPump() {
-		sPump = "ON"
-	} else {
-		sPump = "OFF"
+func setDiverterEnabled(w http.ResponseWriter, r *http.Request, enabled bool) {
+	name := mux.Vars(r)["name"]
+	h := Diverters.Get(name)
+	if h == nil {
+		http.Error(w, fmt.Sprintf("Unknown diverter %s", name), http.StatusNotFound)
+		return
 	}
-	_, _ = fmt.Fprintf(w, `{
-	"time":"%s",
-	"tesla":{
-		"maxAmps":%02f,
-		"cars":[`, time.Now().String(), fMaxAmps)
-	for i, s := range slaves {
-		if i > 0 {
-			_, _ = fmt.Fprint(w, ',')
-		}
-		_, _ = fmt.Fprintf(w, `
-			{
-				"Current":%0.2f,
-				"maxAmps":%0.2f,
-				"status":"%s"
-			}`, float32(s.GetCurrent())/100, float32(s.GetAllowed())/100, s.GetStatus())
-	}
-	_, _ = fmt.Fprintf(w, `
-		]},
-	"heater":{
-		"setting":%d,
-		"pump":"%s",
-		"enabled":"%s"
-	},
-	"inverter":{
-		"frequency":%0.2f,
-		"vSetpoint":%0.2f,
-		"vBatt":%0.2f,
-		"iBatt":%0.2f,
-		"soc":%0.2f,
-%s
-	}
-}`, Heater.GetSetting(), sPump, Heater.GetEnabled(), iValues.GetFrequency(), iValues.GetSetPoint(), iValues.GetVolts(), iValues.GetAmps(), iValues.GetSOC(), iValues.GetFlags())
+	h.SetEnabled(enabled)
+	getValues(w, r)
+}
+
+func setAllocationPolicy(w http.ResponseWriter, r *http.Request) {
+	err := Allocator.SetPolicy(mux.Vars(r)["policy"])
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s - choose one of %v", err, chargeAllocator.GetPolicies()), http.StatusBadRequest)
+		return
+	}
+	getValues(w, r)
+}
+
+// Set the priority for a slave. The address is in hex as shown in the logs.
+func setSlavePriority(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	address, err := strconv.ParseUint(vars["address"], 16, 16)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid slave address %s", vars["address"]), http.StatusBadRequest)
+		return
+	}
+	priority, err := strconv.Atoi(vars["priority"])
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid priority %s", vars["priority"]), http.StatusBadRequest)
+		return
+	}
+	Allocator.SetPriority(uint(address), priority)
+	getValues(w, r)
 }
 
 func handleCANFrame(frm can.Frame) {
@@ -289,20 +544,11 @@ func init() {
 	// Initialise the current values
 
 	TeslaParameters.Reset()
-	Heater = heaterSetting.New()
+	Allocator = chargeAllocator.New()
+	Overrides = chargeOverride.New()
+	Events = eventStream.New()
 
 	flag.Usage = usage
-	_ = flag.Set("log_dir", "/var/log")
-	_ = flag.Set("stderrthreshold", "INFO")
-	// NOTE: This next line is key you have to call flag.Parse() for the command line
-	// options or "flags" that are defined in the glog module to be picked up.
-	flag.Parse()
-
-	// Set up logging
-	logwriter, e := syslog.New(syslog.LOG_NOTICE, "myprog")
-	if e == nil {
-		log.SetOutput(logwriter)
-	}
 
 	// Get the settings
 	flag.StringVar(&address, "a", "/dev/serial/by-path/platform-3f980000.usb-usb-0:1.2:1.0-port0", "Serial port address")
@@ -311,19 +557,67 @@ func init() {
 	flag.IntVar(&stopbits, "s", 1, "Serial port stop bits")
 	flag.StringVar(&parity, "p", "N", "Serial port parity (N/E/O)")
 	flag.UintVar(&masterAddress, "m", 0x7777, "Master TWC address")
-	flag.UintVar(&apiPort, "i", 0x8080, "WEB port to listen on for API connections")
+	flag.UintVar(&apiPort, "i", 8080, "WEB port to listen on for API connections unless the configuration gives one")
 	flag.StringVar(&databaseServer, "q", "127.0.0.1", "MySQL Server")
 	flag.StringVar(&databaseName, "n", "logging", "Database name")
 	flag.StringVar(&databaseLogin, "u", "logger", "Database login user name")
 	flag.StringVar(&databasePassword, "w", "logger", "Database user password")
 	flag.StringVar(&databasePort, "o", "3306", "Database port")
 	flag.BoolVar(&listenMode, "l", false, "Listen Mode prints output to stdout instead of sending over the wire.")
-	flag.Parse()
+	flag.BoolVar(&followMode, "f", false, "Follow Mode decodes the traffic from an existing TWC master and its slaves without sending anything.")
+	flag.StringVar(&configFile, "c", "/etc/TeslaChargeControl.json", "Configuration file")
+	flag.StringVar(&gpioDriver, "g", "rpio", "GPIO driver for the heater (rpio/gpiochip/fake)")
+	flag.StringVar(&gpioChip, "gc", "/dev/gpiochip0", "GPIO character device used by the gpiochip driver")
+	flag.StringVar(&captureFile, "t", "", "Capture the RS485 traffic to this file")
+	flag.StringVar(&replayFile, "r", "", "Replay the RS485 traffic from this capture file instead of using the serial port")
+	flag.StringVar(&stateDir, "sd", "/var/lib/TeslaChargeControl", "Directory to keep state in across restarts")
+}
+
+// Things the controller talks to. main opens them from the command line settings. Tests pass in their own.
+type dependencies struct {
+	port serial.Port                // RS485 to the wall chargers
+	bus  *can.Bus                   // Inverter CAN bus. nil to run without the inverters
+	db   *sql.DB                    // Logging database. nil leaves the database logger to connect when it can
+	gpio heaterSetting.OutputDriver // Heater, pump and fan outputs
+}
 
-	// Set up the API WEB Site
-	go setUpWebSite()
+// Load the configuration file given on the command line
+func loadConfig() {
+	var err error
+	Config, err = config.Load(configFile)
+	if err != nil {
+		glog.Fatalf("Failed to read the configuration from %s - %s - Sorry, I am giving up.", configFile, err)
+	}
+}
 
-	config := serial.Config{
+// Open the serial port, CAN bus, database and GPIO from the command line settings. We can't run without the serial
+// port, the inverters or the GPIO. The database can come later.
+func openDependencies() dependencies {
+	var deps dependencies
+	switch gpioDriver {
+	case "rpio":
+		deps.gpio = heaterSetting.NewRpioDriver()
+	case "gpiochip":
+		deps.gpio = heaterSetting.NewChipDriver(gpioChip)
+	case "fake":
+		deps.gpio = heaterSetting.NewFakeDriver()
+	default:
+		glog.Fatalf("Unknown GPIO driver %s - Sorry, I am giving up.", gpioDriver)
+	}
+
+	if replayFile != "" {
+		// Play back a capture instead of talking to the chargers. Leave the CAN bus and the database alone.
+		r, err := twcCapture.Open(replayFile)
+		if err != nil {
+			glog.Fatalf("ERROR - %s - Cannot open the capture file %s.\nSorry. I am givng up!", err, replayFile)
+		}
+		deps.port = twcCapture.NewReplayPort(r)
+		glog.Infof("Replaying Tesla Wall Charger traffic from %s", replayFile)
+		glog.Flush()
+		return deps
+	}
+
+	serialConfig := serial.Config{
 		Address:  address,
 		BaudRate: baudrate,
 		DataBits: databits,
@@ -332,16 +626,25 @@ func init() {
 		Timeout:  1, //30 * time.Second,
 	}
 
-	p, err := serial.Open(&config)
+	p, err := serial.Open(&serialConfig)
 	if err != nil {
 		glog.Fatalf("ERROR - %s - Cannot connect to the Tesla RS485 port.\nSorry. I am givng up!", err)
 	} else {
 		glog.Info("Connected to Tesla Wall Charger.")
 	}
 	glog.Flush()
-	port = p
+	deps.port = p
+
+	if captureFile != "" {
+		capture, err = twcCapture.Create(captureFile)
+		if err != nil {
+			glog.Fatalf("ERROR - %s - Cannot create the capture file %s.\nSorry. I am givng up!", err, captureFile)
+		}
+		deps.port = twcCapture.NewPort(p, capture)
+		glog.Infof("Capturing Tesla Wall Charger traffic to %s", captureFile)
+	}
 
-	bus, err := can.NewBusForInterfaceWithName("can0")
+	deps.bus, err = can.NewBusForInterfaceWithName("can0")
 	if err != nil {
 		glog.Fatalf("Error starting CAN interface - %s -\nSorry, I am giving up", err)
 	} else {
@@ -349,17 +652,96 @@ func init() {
 	}
 	glog.Flush()
 
-	// Set up the database connection
-	pDB, err = connectToDatabase()
+	// Set up the database connection. The database logger keeps trying if it isn't there yet.
+	deps.db, err = connectToDatabase()
 	if err != nil {
-		glog.Fatalf("Failed to connec to to the database - %s - Sorry, I am giving up.", err)
+		glog.Errorf("Failed to connect to the database - %s - Carrying on without it.", err)
 	} else {
 		glog.Info("Connected to the database")
 	}
 	glog.Flush()
+	return deps
+}
+
+// Set up the heaters from the configuration and start using the hardware in deps
+func startUp(deps dependencies) {
+	port = deps.port
+	pDB = deps.db
+
+	// Set up the heaters
+	Diverters = diverters.New()
+	for _, d := range Config.GetDiverters() {
+		c := d.Config
+		if (c.Legionella != nil) && (c.Legionella.StateFile == "") {
+			l := *c.Legionella
+			l.StateFile = filepath.Join(stateDir, d.Name+"-legionella.json")
+			c.Legionella = &l
+		}
+		if c.ElementStateFile == "" {
+			c.ElementStateFile = filepath.Join(stateDir, d.Name+"-elements.json")
+		}
+		Diverters.Add(d.Name, d.Priority, heaterSetting.New(deps.gpio, c))
+	}
+	Heater = Diverters.GetPrimary()
+	if Config.Fan != nil {
+		Fan = pumpControl.NewFan(deps.gpio, *Config.Fan, func() bool { return Diverters.GetWatts() > 0 })
+		go Fan.Run()
+	}
+	if replayFile != "" {
+		// The heaters stay off without their temperatures
+		return
+	}
+
+	startTemperatureWatchers()
+	startSolarPump(deps.gpio)
 
 	// Start handling incoming CAN messages
-	go processCANFrames(bus)
+	if deps.bus != nil {
+		go processCANFrames(deps.bus)
+	}
+}
+
+// Start reading the tank temperature for every diverter that has a temperature source
+func startTemperatureWatchers() {
+	for _, d := range Config.GetDiverters() {
+		t := d.GetTemperature()
+		if t == nil {
+			continue
+		}
+		source, err := heaterSetting.NewTemperatureSource(*t, func() *sql.DB { return pDB })
+		if err != nil {
+			// Leave the heater at its initial temperature which keeps it turned off
+			glog.Errorf("Cannot read the temperature for %s - %s", d.Name, err)
+			glog.Flush()
+			continue
+		}
+		go Diverters.Get(d.Name).WatchTemperature(source, t.GetInterval(), t.GetMaxAge())
+	}
+}
+
+// Start the solar collector pump if there is one
+func startSolarPump(gpio heaterSetting.OutputDriver) {
+	if Config.SolarPump == nil {
+		return
+	}
+	db := func() *sql.DB { return pDB }
+	collector, err := heaterSetting.NewTemperatureSource(Config.SolarPump.Collector, db)
+	if err != nil {
+		glog.Errorf("Cannot read the solar collector temperature so the solar pump will not run - %s", err)
+		glog.Flush()
+		return
+	}
+	var tank heaterSetting.TemperatureSource = heaterSetting.NewHeaterSource(Heater)
+	if Config.SolarPump.Tank != nil {
+		tank, err = heaterSetting.NewTemperatureSource(*Config.SolarPump.Tank, db)
+		if err != nil {
+			glog.Errorf("Cannot read the solar tank temperature so the solar pump will not run - %s", err)
+			glog.Flush()
+			return
+		}
+	}
+	SolarPump = pumpControl.NewSolarPump(gpio, *Config.SolarPump, collector, tank)
+	go SolarPump.Run()
 }
 
 // This function will look at the various inverter parameters and work out if there is power available for car charging or water heating
@@ -372,8 +754,10 @@ func calculatePowerAvailable() {
 	var soc float32
 	var frequency float64
 	var delta int16
+	var action string
 
 	for {
+		action = "none"
 		vSetpoint = iValues.GetSetPoint()
 		vBatt = iValues.GetVolts()
 		iBatt = iValues.GetAmps()
@@ -382,16 +766,18 @@ func calculatePowerAvailable() {
 
 		// Set the total car charging current for all cars charging
 		carCurrent := float32(0.0)
-		for _, s := range slaves {
+		for _, s := range getSlaves() {
 			carCurrent += float32(s.GetCurrent()) / 100.0
 		}
 		TeslaParameters.SetCurrent(carCurrent)
 
 		//		fmt.Printf ("F = %0.2fHz : Cars = %0.2fA : available = %0.2fA : SOC = %0.2f%%: setpoint = %0.2fV : vBatt = %0.2fV", frequency, carCurrent, TeslaParameters.GetMaxAmps(), soc, vSetpoint, vBatt)
+		// While the generator runs the diverters stay off even if they are boosting or running a legionella cycle
+		Diverters.SetForcedOff(iValues.AutoGn)
 		if iValues.AutoGn {
 			// If the generator is running turn off the Tesla and the auxiliary heater
 			TeslaParameters.SetMaxAmps(0)
-			Heater.SetHeater(0)
+			action = "Generator running. Cars and diverters off"
 		} else if (frequency > 60.8) && (iBatt < 10) {
 			// If the frequency is above 60.8 hertz we are getting more solar power than we are consuming so the first thing to do is check the car
 			// to see if it could use more. If it is charging but at the allowed rate and that rate is less than 48 amps then push it up a bit.
@@ -416,26 +802,34 @@ func calculatePowerAvailable() {
 				}
 				if !TeslaParameters.ChangeCurrent(delta) {
 					// Charge rate increase was not accepted so turn up the auxiliary heater
-					Heater.Increase(frequency)
+					Diverters.Increase(frequency)
+					action = "Surplus power. Cars at their limit so increase the diverters"
 				} else {
 					// Tesla accepted the increase so we should drop the heater a bit ignoring and hold time set
-					Heater.Decrease(true)
+					Diverters.Decrease(true)
+					action = fmt.Sprintf("Surplus power. Increase the cars by %dA", delta)
 				}
 			} else {
 				// No car charging requested so set the available current to 10.0 amps and turn up the auxiliary heater
 				//				fmt.Println("Set car current to 10A and increase heater")
 				TeslaParameters.SetMaxAmps(10.0)
-				Heater.Increase(frequency)
+				Diverters.Increase(frequency)
+				action = "Surplus power. No cars charging so increase the diverters"
 			}
 		} else if frequency > 60.8 {
+			action = "Battery discharging at high frequency. Decrease the cars by 1A"
 			if !TeslaParameters.ChangeCurrent(-1) {
-				Heater.Decrease(true)
+				Diverters.Decrease(true)
+				action = "Battery discharging at high frequency. Decrease the diverters"
 			}
 		} else if frequency < 58 {
 			// If frequency is this low we must be on generator power so stop the Tesla and Heaters
-			if !Heater.Decrease(true) {
+			action = "Frequency very low. Decrease the diverters"
+			if !Diverters.Decrease(true) {
+				action = "Frequency very low. Diverters already off"
 				if carCurrent > 1 {
 					TeslaParameters.ChangeCurrent(int16(0 - carCurrent))
+					action = "Frequency very low. Stop the cars"
 				}
 			}
 
@@ -445,12 +839,15 @@ func calculatePowerAvailable() {
 			// We should dial back the heater and/or car a bit if the battery is less than 95% and not charging or
 			// if we are discharging at more than 10 Amps
 			if (soc < 95.0 && iBatt > 0) || (iBatt > 10) {
-				if !Heater.Decrease(false) {
+				action = "Frequency low. Decrease the diverters"
+				if !Diverters.Decrease(false) {
+					action = "Frequency low. Diverters already off"
 					//				fmt.Println("Heater is off so decrease car current")
 					// if the heater is already off and the car is charging then reduce the car charge rate
 					if carCurrent > 1 {
 						// If the state of charge is 90% or more don't let the car current fall below 8 amps
 						if (soc < 90.0) || (carCurrent > 8) {
+							action = "Frequency low. Decrease the cars"
 							if carCurrent > 35.0 {
 								TeslaParameters.ChangeCurrent(-8)
 							} else if carCurrent > 30.0 {
@@ -477,12 +874,15 @@ func calculatePowerAvailable() {
 				if ((vSetpoint - vBatt) > 5) && (iBatt > -40) {
 					//					fmt.Println ("battery charge voltage is low so decrease heater.")
 					// We are at least 5v below the setpoint so drop the car current or heater rate
-					if !Heater.Decrease(false) {
+					action = "Battery below its setpoint. Decrease the diverters"
+					if !Diverters.Decrease(false) {
+						action = "Battery below its setpoint. Diverters already off"
 						// Heater is off so drop the charge rate available if there is a car charging to keep at least
 						// 5 amps going into the battery
 						if (carCurrent > 1.0) && (iBatt > -5) {
 							//							fmt.Println("Heater is off and car is charging so decrease car.
 							TeslaParameters.ChangeCurrent(-2)
+							action = "Battery below its setpoint. Decrease the cars by 2A"
 						}
 					}
 				} else if ((vSetpoint - vBatt) < 1) || (iBatt < -80) {
@@ -491,24 +891,29 @@ func calculatePowerAvailable() {
 						//						fmt.Println("Car is charging so increase current.")
 						if !TeslaParameters.ChangeCurrent(+1) {
 							//							fmt.Println("Car current = max so increase heater")
-							Heater.Increase(frequency)
+							Diverters.Increase(frequency)
+							action = "Battery at its setpoint. Cars at their limit so increase the diverters"
 						} else {
-							Heater.Decrease(true)
+							Diverters.Decrease(true)
+							action = "Battery at its setpoint. Increase the cars by 1A"
 						}
 					} else {
 						if TeslaParameters.GetMaxAmps() < 10 {
 							//							Set Tesla charge current to 10 Amps minimum to make sure the car gets a chance to charge if it needs it
 							TeslaParameters.ChangeCurrent(10 - int16(TeslaParameters.GetMaxAmps()))
+							action = "Battery at its setpoint. Offer the cars 10A"
 						} else {
 							//							Car is not charging so increase heater.
-							Heater.Increase(frequency)
+							Diverters.Increase(frequency)
+							action = "Battery at its setpoint. No cars charging so increase the diverters"
 						}
 					}
 				} else {
 					// If the car is trying to charge give it at least 44 amps before allowing the heaters to run
-					if (carCurrent > 1.0) && (Heater.GetSetting() > 0) && (carCurrent < 44) {
-						Heater.Decrease(false)
+					if (carCurrent > 1.0) && (Diverters.GetWatts() > 0) && (carCurrent < 44) {
+						Diverters.Decrease(false)
 						TeslaParameters.ChangeCurrent(+2)
+						action = "Give the cars priority over the diverters"
 					}
 				}
 			} else {
@@ -518,30 +923,39 @@ func calculatePowerAvailable() {
 					if carCurrent > 1 {
 						if !TeslaParameters.ChangeCurrent(1) {
 							//							fmt.Println("Car is maxed out so add in heaters")
-							Heater.Increase(frequency)
+							Diverters.Increase(frequency)
+							action = "Battery full. Cars at their limit so increase the diverters"
 						} else {
 							// Give priority to the car if it is charging
-							Heater.Decrease(false)
+							Diverters.Decrease(false)
+							action = "Battery full. Increase the cars by 1A"
 						}
 					}
 				} else if iBatt > 15 {
 					//					fmt.Println("Battery is discharging more than 15 Amps so decrease heaters")
-					if !Heater.Decrease(false) {
+					action = "Battery discharging. Decrease the diverters"
+					if !Diverters.Decrease(false) {
+						action = "Battery discharging. Diverters already off"
 						if carCurrent > 1 {
 							//							fmt.Println("Heaters off and cars are charging so drop the rate if the car current
 							//							is more than 8 amps or the state of charge is below 90%")
 							if (soc < 95.0) || (carCurrent > 8) {
 								TeslaParameters.ChangeCurrent(-2)
+								action = "Battery discharging. Decrease the cars by 2A"
 							}
 						}
 					}
 				}
 			}
 		}
+		publishDecision(frequency, vSetpoint, vBatt, iBatt, soc, carCurrent, action)
 		time.Sleep(time.Second * 2)
 	}
 }
 
+// Seconds an element has to run between log entries if it isn't switched
+const elementLogInterval = 15 * 60
+
 func CloseDB() {
 	_ = pDB.Close()
 }
@@ -556,10 +970,12 @@ func logToDatabase() {
 	last_soc := iValues.GetSOC()
 	last_iAvailable := TeslaParameters.GetMaxAmps()
 	last_iUsed := TeslaParameters.GetCurrent()
-	last_heaterSetting := Heater.GetSetting()
+	last_heaterMask := Heater.GetElementMask()
+	last_heaterWatts := Heater.GetWatts()
 	last_heaterPump := Heater.GetPump()
+	lastSlaveEnergy := make(map[uint]int)
+	lastElementStats := make(map[string]heaterSetting.ElementStats)
 	var err error
-	hotTankTemp := int16(1000)
 
 	for {
 		new_frequency := iValues.GetFrequency()
@@ -569,12 +985,14 @@ func logToDatabase() {
 		new_soc := iValues.GetSOC()
 		new_iAvailable := TeslaParameters.GetMaxAmps()
 		new_iUsed := TeslaParameters.GetCurrent()
-		new_heaterSetting := Heater.GetSetting()
+		new_heaterMask := Heater.GetElementMask()
+		new_heaterWatts := Heater.GetWatts()
 		new_heaterPump := Heater.GetPump()
 
 		if pDB == nil {
 			pDB, err = connectToDatabase()
 			if err != nil {
+				atomic.AddUint64(&databaseErrors, 1)
 				glog.Errorf("Error opening the database ", err)
 				glog.Flush()
 				pDB = nil
@@ -591,6 +1009,7 @@ func logToDatabase() {
 			last_soc = new_soc
 			var _, err = pDB.Exec("call log_inverter_values(?, ?, ?, ?, ?)", new_frequency, new_vSetpoint, new_vBatt, new_iBatt, new_soc)
 			if err != nil {
+				atomic.AddUint64(&databaseErrors, 1)
 				glog.Errorf("Error writing inverter values to the database - %s", err)
 				glog.Flush()
 				_ = pDB.Close()
@@ -604,6 +1023,7 @@ func logToDatabase() {
 			last_iUsed = new_iUsed
 			_, err := pDB.Exec("call log_tesla_values(?, ?)", new_iAvailable, new_iUsed)
 			if err != nil {
+				atomic.AddUint64(&databaseErrors, 1)
 				glog.Errorf("Error writing Tesla values to the database - %s", err)
 				glog.Flush()
 				_ = pDB.Close()
@@ -612,12 +1032,14 @@ func logToDatabase() {
 				continue
 			}
 		}
-		if (new_heaterSetting != last_heaterSetting) || (new_heaterPump != last_heaterPump) {
-			last_heaterSetting = new_heaterSetting
+		if (new_heaterMask != last_heaterMask) || (new_heaterPump != last_heaterPump) {
+			last_heaterMask = new_heaterMask
 			last_heaterPump = new_heaterPump
 			last_iUsed = new_iUsed
-			_, err := pDB.Exec("call log_heater_values(?, ?)", new_heaterSetting, new_heaterPump)
+			// The database has always been given the elements that are on rather than the power level
+			_, err := pDB.Exec("call log_heater_values(?, ?)", new_heaterMask, new_heaterPump)
 			if err != nil {
+				atomic.AddUint64(&databaseErrors, 1)
 				glog.Errorf("Error writing heater values to the database - %s", err)
 				glog.Flush()
 				_ = pDB.Close()
@@ -626,36 +1048,101 @@ func logToDatabase() {
 				continue
 			}
 		}
-		// Get the hot tank temperature
-		var err = pDB.QueryRow("select greatest(TSH0, TSH1, TSH2) as maxtemp from chillii_analogue_input where TIMESTAMP > date_add(now(), interval -5 minute) order by TIMESTAMP desc limit 1").Scan(&hotTankTemp)
-		if err != nil {
-			Heater.SetHotTankTemp(1000) // Be safe. If we can't get the temperature assume it is boiling to shut down the heater.
-			glog.Errorf("Error fetching hot tank temperature from the database - %s", err)
-			glog.Flush()
-			err = pDB.Close()
-			pDB = nil
-			time.Sleep(time.Second)
-			continue
+		if new_heaterWatts != last_heaterWatts {
+			last_heaterWatts = new_heaterWatts
+			// The power level has a procedure of its own defined in sql/heater_watts.sql. Carry on without it if it
+			// hasn't been installed.
+			_, err := pDB.Exec("call log_heater_watts(?)", new_heaterWatts)
+			if err != nil {
+				atomic.AddUint64(&databaseErrors, 1)
+				glog.Errorf("Error writing the heater power to the database - %s", err)
+				glog.Flush()
+			}
+		}
+		// Log each charger's meter readings when its lifetime energy changes. The procedure is defined in
+		// sql/tesla_slave_energy.sql. A failed reading is skipped and the next one is tried when it changes.
+		for _, s := range getSlaves() {
+			if s.GetLifetimeEnergy() == 0 || lastSlaveEnergy[s.GetAddress()] == s.GetLifetimeEnergy() {
+				continue
+			}
+			lastSlaveEnergy[s.GetAddress()] = s.GetLifetimeEnergy()
+			volts := s.GetPhaseVolts()
+			_, err := pDB.Exec("call log_tesla_slave_energy(?, ?, ?, ?, ?)", s.GetAddress(), s.GetLifetimeEnergy(), volts[0], volts[1], volts[2])
+			if err != nil {
+				atomic.AddUint64(&databaseErrors, 1)
+				glog.Errorf("Error writing the energy for Tesla slave %04x to the database - %s", s.GetAddress(), err)
+				glog.Flush()
+			}
+		}
+		// Log each heater element's run time when it is switched on and every so often while it runs. The procedure is
+		// defined in sql/heater_element.sql. A failed entry is skipped until the element next needs logging.
+		for _, d := range Diverters.GetAll() {
+			for _, e := range d.Heater.GetElementStats() {
+				key := fmt.Sprintf("%s/%d", d.Name, e.Pin)
+				last, found := lastElementStats[key]
+				if found && (last.Cycles == e.Cycles) && (e.OnSeconds-last.OnSeconds < elementLogInterval) {
+					continue
+				}
+				lastElementStats[key] = e
+				_, err := pDB.Exec("call log_heater_element(?, ?, ?, ?, ?)", d.Name, e.Pin, int64(e.OnSeconds), e.Cycles, e.KWh)
+				if err != nil {
+					atomic.AddUint64(&databaseErrors, 1)
+					glog.Errorf("Error writing the run time of %s element %d to the database - %s", d.Name, e.Pin, err)
+					glog.Flush()
+				}
+			}
 		}
-		Heater.SetHotTankTemp(hotTankTemp)
 		time.Sleep(time.Second)
 	}
 }
 
 func main() {
-	var buf [1]byte
-	var chars int
-	var lastchar byte
-	var linkReadyNum int
-	var err interface{}
+	_ = flag.Set("log_dir", "/var/log")
+	_ = flag.Set("stderrthreshold", "INFO")
+	// NOTE: This next line is key you have to call flag.Parse() for the command line
+	// options or "flags" that are defined in the glog module to be picked up.
+	flag.Parse()
+
+	// Set up logging
+	logwriter, e := syslog.New(syslog.LOG_NOTICE, "myprog")
+	if e == nil {
+		log.SetOutput(logwriter)
+	}
+
+	loadConfig()
+	startUp(openDependencies())
 
 	defer func() {
-		err = port.Close()
+		err := port.Close()
 		if err != nil {
 			glog.Fatal(err)
 		}
 	}()
 
+	// Start the power management loop
+	go calculatePowerAvailable()
+	go streamStatus()
+	go recordHistory()
+
+	// Set up the API WEB Site now everything it reports on is ready
+	setUpWebSite()
+	go shutdownOnSignal()
+	defer shutdown()
+
+	if replayFile == "" {
+		go logToDatabase()
+	}
+
+	runMaster(nil)
+}
+
+// Talk to the wall chargers as their master until done is closed or a replay ends
+func runMaster(done <-chan struct{}) {
+	var buf [1]byte
+	var chars int
+	var lastchar byte
+	var linkReadyNum int
+
 	linkReadyNum = 10
 
 	msg := twcMessage.New(port, listenMode)
@@ -664,12 +1151,16 @@ func main() {
 	lastchar = 0
 	t := time.Now()
 
-	// Start the power management loop
-	go calculatePowerAvailable()
-
-	go logToDatabase()
-
 	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if followMode {
+			// Leave the talking to the real master
+			t = time.Now()
+		}
 		if time.Since(t) > time.Second {
 			if linkReadyNum > 5 {
 				msg.SendMasterLinkReady1(masterAddress)
@@ -681,6 +1172,9 @@ func main() {
 			if len(slaves) > 0 {
 				divideMaxAmpsAmongstSlaves(slaves, int(TeslaParameters.GetMaxAmps()*100))
 				sendHearbeatsToSlaves(slaves, masterAddress)
+				requestIdentityFromSlaves(slaves, masterAddress)
+				requestVINFromSlaves(slaves, masterAddress)
+				requestEnergyFromSlaves(slaves, masterAddress)
 				linkReadyNum = 0
 			}
 			if linkReadyNum < 0 {
@@ -690,6 +1184,11 @@ func main() {
 		}
 		for {
 			_, err := port.Read(buf[:])
+			if err == io.EOF && replayFile != "" {
+				glog.Info("End of the capture file")
+				glog.Flush()
+				return
+			}
 			if err != nil {
 				if err != serial.ErrTimeout {
 					fmt.Println(err)
@@ -708,18 +1207,39 @@ func main() {
 			}
 			if msg.IsComplete() {
 				if !msg.IsValid() {
+					atomic.AddUint64(&invalidFrames, 1)
 					glog.Errorln("Invalid message received!")
 					glog.Flush()
 				} else {
 					switch msg.GetCode() {
-					//						case 0xfbe0 : fmt.Printf("To Slave %04x | Status = %02x | SetPoint = %0.2f | = %0.2f\n", msg.GetToAddress(), msg.GetStatus(), float32(msg.GetSetPoint()) / 100, float32(msg.GetCurrent()) / 100)
+					case 0xfbe0:
+						if followMode {
+							processMasterHeartbeat(msg, &slaves)
+						} else {
+							glog.Errorf("Heartbeat from another master %04x to slave %04x\n", msg.GetFromAddress(), msg.GetToAddress())
+							glog.Flush()
+						}
+					case 0xfce1, 0xfbe2:
+						if followMode {
+							processMasterLinkReady(msg)
+						} else {
+							glog.Errorf("Link ready from another master %04x\n", msg.GetFromAddress())
+							glog.Flush()
+						}
 					case 0xfde0:
 						logData(msg, &slaves)
 					case 0xfde2:
 						processSlaveLinkReady(msg, &slaves)
-						//						case 0xfce1 : fmt.Println("Master Link Ready 1 received")
-						//						case 0xfbe2 : fmt.Println("Master Link Ready 2 received")
+					case 0xfdeb:
+						processSlaveEnergy(msg, &slaves)
+					case 0xfd19:
+						processSlaveSerialNumber(msg, &slaves)
+					case 0xfd1b:
+						processSlaveFirmwareVersion(msg, &slaves)
+					case 0xfdee, 0xfdef, 0xfdf1:
+						processSlaveVIN(msg, &slaves)
 					default:
+						atomic.AddUint64(&unknownCodes, 1)
 						glog.Errorf("Unknown message code %04x\n", msg.GetCode())
 						glog.Flush()
 						msg.Print()
@@ -732,6 +1252,7 @@ func main() {
 		if s != nil {
 			slaves = s
 		}
+		publishSlaves()
 		time.Sleep(100 * time.Millisecond)
 	}
 }
@@ -0,0 +1,723 @@
+package main
+
+import (
+	"TeslaChargeControl/InverterValues"
+	"TeslaChargeControl/chargeAllocator"
+	"TeslaChargeControl/chargeOverride"
+	"TeslaChargeControl/diverters"
+	"TeslaChargeControl/heaterSetting"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Version 1 of the HTTP API. Everything is served under /api/v1 as JSON.
+//
+// Units are the same everywhere. Currents are Amps, power is Watts, energy is kWh, temperatures are Deg C,
+// frequencies are Hz, times are RFC 3339 and durations are seconds. Charger addresses are 4 hex digits.
+//
+//	GET  /api/v1/status                                    Everything below in one response
+//	GET  /api/v1/tesla                                     Charging mode, limits and cars
+//	GET  /api/v1/cars                                      Cars only
+//	GET  /api/v1/heater                                    The hot water tank heater
+//	GET  /api/v1/diverters                                 Every load surplus power can go to
+//	GET  /api/v1/pumps                                     Solar pump and fan
+//	GET  /api/v1/inverter                                  Inverter readings and flags
+//	GET  /api/v1/history?since=2024-05-01T10:00:00Z       Readings every 30 seconds for the last day. See history.go
+//	POST /api/v1/heater/enable | disable                   Enable or disable every diverter
+//	POST /api/v1/diverters/{name}/enable | disable         Enable or disable one diverter
+//	POST /api/v1/allocationPolicy/{policy}                 Choose how current is shared between cars
+//	POST /api/v1/cars/{address}/priority/{priority}        Set a car's priority
+//	POST /api/v1/charge/current/{amps}?for=1h30m           Share a fixed current between the cars
+//	POST /api/v1/charge/pause?for=1h                       Stop charging
+//	POST /api/v1/charge/resume                             Undo a pause
+//	POST /api/v1/charge/now?for=4h                         Charge at the most the wiring allows whatever the solar is doing
+//	POST /api/v1/charge/auto                               Clear every charging override
+//	POST /api/v1/cars/{address}/current/{amps}?for=2h      Give one car a fixed current
+//	POST /api/v1/cars/{address}/auto                       Put one car back to sharing
+//	GET  /api/v1/stream?interval=1s&events=tesla,inverter  Live status as Server-Sent Events
+//	GET  /api/v1/ws?interval=1s&events=tesla,inverter      Live status over a WebSocket
+//
+// Charging overrides last for the time given in "for" (a Go duration such as 90m) or two hours if it isn't given.
+// for=0 lasts until the override is cleared.
+//
+// The streams send an event whenever part of the status changes, no more often than interval (default and minimum
+// 100ms). events picks the event types wanted (tesla, heater, diverters, pumps, inverter, decision and history). Leave
+// it out to get them all. See stream.go.
+//
+// Anything that changes a setting must be a POST and needs the operator role. See auth.go.
+//
+// The actions return the full status. Errors are returned as {"error":"..."} with a suitable status code.
+//
+// "/" still returns the original layout for older clients. The dashboard is at /dashboard/.
+
+const apiV1Prefix = "/api/v1"
+
+type StatusResponse struct {
+	Time      time.Time        `json:"time"`
+	Tesla     TeslaStatus      `json:"tesla"`
+	Heater    HeaterStatus     `json:"heater"`
+	Diverters []DiverterStatus `json:"diverters"`
+	Pumps     PumpStatus       `json:"pumps"`
+	Inverter  InverterStatus   `json:"inverter"`
+}
+
+type TeslaStatus struct {
+	Mode             string         `json:"mode"` // master or follow
+	MasterAddress    string         `json:"masterAddress"`
+	MaxAmps          float32        `json:"maxAmps"`     // Current available to share between the cars
+	CurrentAmps      float32        `json:"currentAmps"` // Current all the cars are drawing
+	SystemMaxAmps    float32        `json:"systemMaxAmps"`
+	AllocationPolicy string         `json:"allocationPolicy"`
+	Override         OverrideStatus `json:"override"`
+	Cars             []CarStatus    `json:"cars"`
+}
+
+type OverrideStatus struct {
+	Mode    string     `json:"mode"`    // auto, manual, paused or chargeNow
+	Amps    float32    `json:"amps"`    // Only used by manual
+	Expires *time.Time `json:"expires"` // null if the override lasts until it is cleared
+}
+
+type CarStatus struct {
+	Address         string          `json:"address"`
+	ProtocolVersion int             `json:"protocolVersion"`
+	Status          string          `json:"status"`
+	CurrentAmps     float32         `json:"currentAmps"` // Current the car is drawing
+	AllowedAmps     float32         `json:"allowedAmps"` // Current the car has been offered
+	RatingAmps      float32         `json:"ratingAmps"`  // Wall connector rating
+	LimitAmps       float32         `json:"limitAmps"`   // Most current we will offer
+	MinimumAmps     float32         `json:"minimumAmps"` // Least current worth offering
+	Priority        int             `json:"priority"`
+	VIN             string          `json:"vin"`
+	SerialNumber    string          `json:"serialNumber"`
+	Firmware        string          `json:"firmware"`
+	LifetimeKWh     int             `json:"lifetimeKWh"`
+	Volts           [3]int          `json:"volts"`     // L1, L2, L3
+	PhaseAmps       [3]float32      `json:"phaseAmps"` // L1, L2, L3 from the heartbeat current
+	Override        *OverrideStatus `json:"override"`  // null unless the car has its own override
+}
+
+type HeaterStatus struct {
+	Setting  uint8 `json:"setting"` // Power level. 0 is off
+	Watts    int   `json:"watts"`
+	MaxWatts int   `json:"maxWatts"`
+	Pump     bool  `json:"pump"`
+	Enabled  bool  `json:"enabled"`
+}
+
+type DiverterStatus struct {
+	Name     string `json:"name"`
+	Priority int    `json:"priority"`
+	HeaterStatus
+	Temperature       float32                      `json:"temperature"`
+	TemperatureStale  bool                         `json:"temperatureStale"`
+	TargetTemperature float32                      `json:"targetTemperature"`
+	CutOffTemperature float32                      `json:"cutOffTemperature"`
+	BoostTemperature  float32                      `json:"boostTemperature"`
+	Boosting          bool                         `json:"boosting"`
+	ForcedOff         bool                         `json:"forcedOff"` // Held off while the generator runs
+	Legionella        LegionellaStatus             `json:"legionella"`
+	Flow              bool                         `json:"flow"`
+	WaitingForFlow    bool                         `json:"waitingForFlow"`
+	Elements          []heaterSetting.ElementStats `json:"elements"`
+}
+
+type LegionellaStatus struct {
+	LastCycle *time.Time `json:"lastCycle"` // null if the tank has never completed a cycle or has no legionella cycle
+	Due       bool       `json:"due"`
+	Forcing   bool       `json:"forcing"`
+}
+
+type PumpStatus struct {
+	SolarPump *SolarPumpStatus `json:"solarPump"` // null if there is no solar pump
+	Fan       *FanStatus       `json:"fan"`       // null if there is no fan
+}
+
+type SolarPumpStatus struct {
+	Running              bool    `json:"running"`
+	Speed                float32 `json:"speed"` // 0 to 1
+	CollectorTemperature float32 `json:"collectorTemperature"`
+	TankTemperature      float32 `json:"tankTemperature"`
+	Fault                bool    `json:"fault"`
+}
+
+type FanStatus struct {
+	On bool `json:"on"`
+}
+
+type InverterStatus struct {
+	FrequencyHz   float64              `json:"frequencyHz"`
+	SetpointVolts float32              `json:"setpointVolts"`
+	BatteryVolts  float32              `json:"batteryVolts"`
+	BatteryAmps   float32              `json:"batteryAmps"`
+	SOC           float32              `json:"soc"` // Percent
+	Flags         InverterValues.Flags `json:"flags"`
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+func setUpAPIv1(router *mux.Router) {
+	api := router.PathPrefix(apiV1Prefix).Subrouter()
+	api.HandleFunc("/status", getStatus).Methods("GET")
+	api.HandleFunc("/tesla", func(w http.ResponseWriter, _ *http.Request) { writeJSON(w, http.StatusOK, buildTeslaStatus()) }).Methods("GET")
+	api.HandleFunc("/cars", func(w http.ResponseWriter, _ *http.Request) { writeJSON(w, http.StatusOK, buildCarStatus()) }).Methods("GET")
+	api.HandleFunc("/heater", func(w http.ResponseWriter, _ *http.Request) { writeJSON(w, http.StatusOK, buildHeaterStatus(Heater)) }).Methods("GET")
+	api.HandleFunc("/diverters", func(w http.ResponseWriter, _ *http.Request) { writeJSON(w, http.StatusOK, buildDiverterStatus()) }).Methods("GET")
+	api.HandleFunc("/pumps", func(w http.ResponseWriter, _ *http.Request) { writeJSON(w, http.StatusOK, buildPumpStatus()) }).Methods("GET")
+	api.HandleFunc("/inverter", func(w http.ResponseWriter, _ *http.Request) { writeJSON(w, http.StatusOK, buildInverterStatus()) }).Methods("GET")
+	api.HandleFunc("/heater/enable", apiEnableHeater).Methods("POST")
+	api.HandleFunc("/heater/disable", apiDisableHeater).Methods("POST")
+	api.HandleFunc("/diverters/{name}/enable", apiEnableDiverter).Methods("POST")
+	api.HandleFunc("/diverters/{name}/disable", apiDisableDiverter).Methods("POST")
+	api.HandleFunc("/allocationPolicy/{policy}", apiSetAllocationPolicy).Methods("POST")
+	api.HandleFunc("/cars/{address}/priority/{priority}", apiSetSlavePriority).Methods("POST")
+	api.HandleFunc("/charge/current/{amps}", apiSetChargeCurrent).Methods("POST")
+	api.HandleFunc("/charge/pause", apiChargeMode(chargeOverride.ModePaused)).Methods("POST")
+	api.HandleFunc("/charge/resume", apiResumeCharging).Methods("POST")
+	api.HandleFunc("/charge/now", apiChargeMode(chargeOverride.ModeChargeNow)).Methods("POST")
+	api.HandleFunc("/charge/auto", apiChargeAuto).Methods("POST")
+	api.HandleFunc("/cars/{address}/current/{amps}", apiSetCarCurrent).Methods("POST")
+	api.HandleFunc("/cars/{address}/auto", apiCarAuto).Methods("POST")
+	api.HandleFunc("/stream", Events.ServeSSE).Methods("GET")
+	api.HandleFunc("/ws", Events.ServeWebSocket).Methods("GET")
+	api.HandleFunc("/history", getHistory).Methods("GET")
+}
+
+// Send v as JSON
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		glog.Errorf("Failed to send the API response - %s", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, ErrorResponse{message})
+}
+
+func getStatus(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, buildStatus())
+}
+
+func buildStatus() StatusResponse {
+	return StatusResponse{
+		Time:      time.Now(),
+		Tesla:     buildTeslaStatus(),
+		Heater:    buildHeaterStatus(Heater),
+		Diverters: buildDiverterStatus(),
+		Pumps:     buildPumpStatus(),
+		Inverter:  buildInverterStatus(),
+	}
+}
+
+func buildTeslaStatus() TeslaStatus {
+	current, maxAmps := TeslaParameters.GetValues()
+	t := TeslaStatus{
+		Mode:             "master",
+		MasterAddress:    fmt.Sprintf("%04x", masterAddress),
+		MaxAmps:          maxAmps,
+		CurrentAmps:      current,
+		SystemMaxAmps:    TeslaParameters.GetSystemMax(),
+		AllocationPolicy: Allocator.GetPolicy(),
+		Override:         buildOverrideStatus(Overrides.Get()),
+		Cars:             buildCarStatus(),
+	}
+	if followMode {
+		t.Mode = "follow"
+		t.MasterAddress = fmt.Sprintf("%04x", followedMaster)
+	}
+	return t
+}
+
+func buildCarStatus() []CarStatus {
+	slaves := getSlaves()
+	cars := make([]CarStatus, 0, len(slaves))
+	for _, s := range slaves {
+		var override *OverrideStatus
+		if o, found := Overrides.GetCar(s.GetAddress()); found {
+			status := buildOverrideStatus(o)
+			override = &status
+		}
+		cars = append(cars, CarStatus{
+			Address:         fmt.Sprintf("%04x", s.GetAddress()),
+			ProtocolVersion: s.GetProtocolVersion(),
+			Status:          s.GetStatus(),
+			CurrentAmps:     float32(s.GetCurrent()) / 100,
+			AllowedAmps:     float32(s.GetAllowed()) / 100,
+			RatingAmps:      float32(s.GetMaxAmps()) / 100,
+			LimitAmps:       float32(s.GetCurrentLimit()) / 100,
+			MinimumAmps:     float32(s.GetMinimumCurrent()) / 100,
+			Priority:        Allocator.GetPriority(s.GetAddress()),
+			VIN:             s.GetVIN(),
+			SerialNumber:    s.GetSerialNumber(),
+			Firmware:        s.GetFirmwareVersion(),
+			LifetimeKWh:     s.GetLifetimeEnergy(),
+			Volts:           s.GetPhaseVolts(),
+			PhaseAmps:       phaseAmps(s.GetPhaseCurrents()),
+			Override:        override,
+		})
+	}
+	return cars
+}
+
+func phaseAmps(currents [3]int) [3]float32 {
+	var amps [3]float32
+	for phase, c := range currents {
+		amps[phase] = float32(c) / 100
+	}
+	return amps
+}
+
+func buildOverrideStatus(o chargeOverride.Override) OverrideStatus {
+	status := OverrideStatus{Mode: o.Mode, Amps: o.Amps}
+	if !o.Expires.IsZero() {
+		status.Expires = &o.Expires
+	}
+	return status
+}
+
+func buildHeaterStatus(h *heaterSetting.HeaterSetting) HeaterStatus {
+	return HeaterStatus{
+		Setting:  h.GetSetting(),
+		Watts:    h.GetWatts(),
+		MaxWatts: h.GetMaxWatts(),
+		Pump:     h.GetPump(),
+		Enabled:  h.GetEnabled() == "ON",
+	}
+}
+
+func buildDiverterStatus() []DiverterStatus {
+	all := Diverters.GetAll()
+	status := make([]DiverterStatus, 0, len(all))
+	for _, d := range all {
+		status = append(status, buildOneDiverterStatus(d))
+	}
+	return status
+}
+
+func getHistory(w http.ResponseWriter, r *http.Request) {
+	var since time.Time
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid time %s - use RFC 3339 such as 2024-05-01T10:00:00Z", s))
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, History.GetSince(since))
+}
+
+func buildOneDiverterStatus(d *diverters.Diverter) DiverterStatus {
+	target, cutOff, boost := d.Heater.GetTemperatureLimits()
+	lastCycle, due, forcing := d.Heater.GetLegionella()
+	flow, waitingForFlow := d.Heater.GetFlow()
+	s := DiverterStatus{
+		Name:              d.Name,
+		Priority:          d.Priority,
+		HeaterStatus:      buildHeaterStatus(d.Heater),
+		Temperature:       float32(d.Heater.GetHotTankTemp()) / 10,
+		TemperatureStale:  d.Heater.GetTemperatureStale(),
+		TargetTemperature: float32(target) / 10,
+		CutOffTemperature: float32(cutOff) / 10,
+		BoostTemperature:  float32(boost) / 10,
+		Boosting:          d.Heater.GetBoosting(),
+		ForcedOff:         d.Heater.GetForcedOff(),
+		Legionella:        LegionellaStatus{Due: due, Forcing: forcing},
+		Flow:              flow,
+		WaitingForFlow:    waitingForFlow,
+		Elements:          d.Heater.GetElementStats(),
+	}
+	if !lastCycle.IsZero() {
+		s.Legionella.LastCycle = &lastCycle
+	}
+	return s
+}
+
+func buildPumpStatus() PumpStatus {
+	var p PumpStatus
+	if SolarPump != nil {
+		running, duty, collector, tank, fault := SolarPump.GetStatus()
+		p.SolarPump = &SolarPumpStatus{
+			Running:              running,
+			Speed:                duty,
+			CollectorTemperature: float32(collector) / 10,
+			TankTemperature:      float32(tank) / 10,
+			Fault:                fault,
+		}
+	}
+	if Fan != nil {
+		p.Fan = &FanStatus{Fan.GetOn()}
+	}
+	return p
+}
+
+func buildInverterStatus() InverterStatus {
+	return InverterStatus{
+		FrequencyHz:   iValues.GetFrequency(),
+		SetpointVolts: iValues.GetSetPoint(),
+		BatteryVolts:  iValues.GetVolts(),
+		BatteryAmps:   iValues.GetAmps(),
+		SOC:           iValues.GetSOC(),
+		Flags:         iValues.GetFlags(),
+	}
+}
+
+func apiEnableHeater(w http.ResponseWriter, r *http.Request) {
+	Diverters.SetEnabled(true)
+	getStatus(w, r)
+}
+
+func apiDisableHeater(w http.ResponseWriter, r *http.Request) {
+	Diverters.SetEnabled(false)
+	Diverters.AllOff()
+	getStatus(w, r)
+}
+
+func apiEnableDiverter(w http.ResponseWriter, r *http.Request) {
+	apiSetDiverterEnabled(w, r, true)
+}
+
+func apiDisableDiverter(w http.ResponseWriter, r *http.Request) {
+	apiSetDiverterEnabled(w, r, false)
+}
+
+func apiSetDiverterEnabled(w http.ResponseWriter, r *http.Request, enabled bool) {
+	name := mux.Vars(r)["name"]
+	h := Diverters.Get(name)
+	if h == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("Unknown diverter %s", name))
+		return
+	}
+	h.SetEnabled(enabled)
+	getStatus(w, r)
+}
+
+func apiSetAllocationPolicy(w http.ResponseWriter, r *http.Request) {
+	err := Allocator.SetPolicy(mux.Vars(r)["policy"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("%s - choose one of %v", err, chargeAllocator.GetPolicies()))
+		return
+	}
+	getStatus(w, r)
+}
+
+func apiSetSlavePriority(w http.ResponseWriter, r *http.Request) {
+	address, ok := carAddress(w, r)
+	if !ok {
+		return
+	}
+	vars := mux.Vars(r)
+	priority, err := strconv.Atoi(vars["priority"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid priority %s", vars["priority"]))
+		return
+	}
+	Allocator.SetPriority(address, priority)
+	getStatus(w, r)
+}
+
+// How long an override should last from the "for" query parameter
+func overrideDuration(r *http.Request) (time.Duration, error) {
+	s := r.URL.Query().Get("for")
+	if s == "" {
+		return chargeOverride.DefaultDuration, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %s - use something like 90m or 2h", s)
+	}
+	return d, nil
+}
+
+func apiSetChargeCurrent(w http.ResponseWriter, r *http.Request) {
+	amps, err := strconv.ParseFloat(mux.Vars(r)["amps"], 32)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid current %s", mux.Vars(r)["amps"]))
+		return
+	}
+	apiSetOverride(w, r, chargeOverride.ModeManual, float32(amps))
+}
+
+// Return a handler that sets the given charging mode
+func apiChargeMode(mode string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		apiSetOverride(w, r, mode, 0)
+	}
+}
+
+func apiSetOverride(w http.ResponseWriter, r *http.Request, mode string, amps float32) {
+	duration, err := overrideDuration(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	err = Overrides.SetMode(mode, amps, duration)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	getStatus(w, r)
+}
+
+func apiResumeCharging(w http.ResponseWriter, r *http.Request) {
+	if Overrides.Get().Mode == chargeOverride.ModePaused {
+		_ = Overrides.SetMode(chargeOverride.ModeAuto, 0, 0)
+	}
+	getStatus(w, r)
+}
+
+func apiChargeAuto(w http.ResponseWriter, r *http.Request) {
+	Overrides.Clear()
+	getStatus(w, r)
+}
+
+// Return the car address from the request or write an error and return false
+func carAddress(w http.ResponseWriter, r *http.Request) (uint, bool) {
+	address, err := strconv.ParseUint(mux.Vars(r)["address"], 16, 16)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid car address %s", mux.Vars(r)["address"]))
+		return 0, false
+	}
+	return uint(address), true
+}
+
+func apiSetCarCurrent(w http.ResponseWriter, r *http.Request) {
+	address, ok := carAddress(w, r)
+	if !ok {
+		return
+	}
+	amps, err := strconv.ParseFloat(mux.Vars(r)["amps"], 32)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid current %s", mux.Vars(r)["amps"]))
+		return
+	}
+	duration, err := overrideDuration(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	err = Overrides.SetCar(address, float32(amps), duration)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	getStatus(w, r)
+}
+
+func apiCarAuto(w http.ResponseWriter, r *http.Request) {
+	address, ok := carAddress(w, r)
+	if !ok {
+		return
+	}
+	Overrides.ClearCar(address)
+	getStatus(w, r)
+}
+
+// The original "/" response. Kept so older clients keep working. New clients should use /api/v1/status.
+
+type legacyResponse struct {
+	Time      string           `json:"time"`
+	Tesla     legacyTesla      `json:"tesla"`
+	Heater    legacyHeater     `json:"heater"`
+	Diverters []legacyDiverter `json:"diverters"`
+	Pumps     legacyPumps      `json:"pumps"`
+	Inverter  legacyInverter   `json:"inverter"`
+}
+
+type legacyTesla struct {
+	Mode             string      `json:"mode"`
+	MasterAddress    string      `json:"masterAddress"`
+	MaxAmps          float32     `json:"maxAmps"`
+	AllocationPolicy string      `json:"allocationPolicy"`
+	Cars             []legacyCar `json:"cars"`
+}
+
+type legacyCar struct {
+	Address      string  `json:"address"`
+	Current      float32 `json:"Current"`
+	MaxAmps      float32 `json:"maxAmps"`
+	Priority     int     `json:"priority"`
+	Status       string  `json:"status"`
+	VIN          string  `json:"vin"`
+	Rating       float32 `json:"rating"`
+	Limit        float32 `json:"limit"`
+	Minimum      float32 `json:"minimum"`
+	SerialNumber string  `json:"serialNumber"`
+	Firmware     string  `json:"firmware"`
+	LifetimeKWh  int     `json:"lifetimeKWh"`
+	VoltsL1      int     `json:"voltsL1"`
+	VoltsL2      int     `json:"voltsL2"`
+	VoltsL3      int     `json:"voltsL3"`
+}
+
+type legacyHeater struct {
+	Setting  uint8  `json:"setting"`
+	Watts    int    `json:"watts"`
+	MaxWatts int    `json:"maxWatts"`
+	Pump     string `json:"pump"`    // ON or OFF
+	Enabled  string `json:"enabled"` // ON or OFF
+}
+
+type legacyDiverter struct {
+	Name     string `json:"name"`
+	Priority int    `json:"priority"`
+	legacyHeater
+	Temperature         float32                      `json:"temperature"`
+	TemperatureStale    bool                         `json:"temperatureStale"`
+	TargetTemperature   float32                      `json:"targetTemperature"`
+	CutOffTemperature   float32                      `json:"cutOffTemperature"`
+	BoostTemperature    float32                      `json:"boostTemperature"`
+	Boosting            bool                         `json:"boosting"`
+	LegionellaLastCycle string                       `json:"legionellaLastCycle"`
+	LegionellaDue       bool                         `json:"legionellaDue"`
+	LegionellaForcing   bool                         `json:"legionellaForcing"`
+	Flow                bool                         `json:"flow"`
+	WaitingForFlow      bool                         `json:"waitingForFlow"`
+	Elements            []heaterSetting.ElementStats `json:"elements"`
+}
+
+type legacyPumps struct {
+	SolarPump *SolarPumpStatus `json:"solarPump"`
+	Fan       *string          `json:"fan"` // ON or OFF
+}
+
+type legacyInverter struct {
+	Frequency float64 `json:"frequency"`
+	VSetpoint float32 `json:"vSetpoint"`
+	VBatt     float32 `json:"vBatt"`
+	IBatt     float32 `json:"iBatt"`
+	SOC       float32 `json:"soc"`
+	legacyFlags
+}
+
+// The flags were sent as quoted strings and the error flag was spelt errror
+type legacyFlags struct {
+	OnRelay1       bool `json:"onRelay1,string"`
+	OnRelay2       bool `json:"onRelay2,string"`
+	OnRelay1Slave1 bool `json:"onRelay1Slave1,string"`
+	OnRelay2Slave1 bool `json:"onRelay2Slave1,string"`
+	OnRelay1Slave2 bool `json:"onRelay1Slave2,string"`
+	OnRelay2Slave2 bool `json:"onRelay2Slave2,string"`
+	GnRun          bool `json:"gnRun,string"`
+	GnRunSlave1    bool `json:"gnRunSlave1,string"`
+	GnRunSlave2    bool `json:"gnRunSlave2,string"`
+	AutoGn         bool `json:"autoGn,string"`
+	AutoLodExt     bool `json:"autoLodExt,string"`
+	AutoLodSoc     bool `json:"autoLodSoc,string"`
+	Tm1            bool `json:"tm1,string"`
+	Tm2            bool `json:"tm2,string"`
+	ExtPwrDer      bool `json:"extPwrDer,string"`
+	ExtVfOk        bool `json:"extVfOk,string"`
+	GdOn           bool `json:"gdOn,string"`
+	Errror         bool `json:"errror,string"`
+	Run            bool `json:"run,string"`
+	BatFan         bool `json:"batFan,string"`
+	AcdCir         bool `json:"acdCir,string"`
+	MccBatFan      bool `json:"mccBatFan,string"`
+	MccAutoLod     bool `json:"mccAutoLod,string"`
+	Chp            bool `json:"chp,string"`
+	ChpAdd         bool `json:"chpAdd,string"`
+	SiComRemote    bool `json:"siComRemote,string"`
+	OverLoad       bool `json:"overLoad,string"`
+	ExtSrcConn     bool `json:"extSrcConn,string"`
+	Silent         bool `json:"silent,string"`
+	Current        bool `json:"current,string"`
+	FeedSelfC      bool `json:"feedSelfC,string"`
+	Esave          bool `json:"esave,string"`
+}
+
+func onOff(on bool) string {
+	if on {
+		return "ON"
+	}
+	return "OFF"
+}
+
+func legacyHeaterFrom(h HeaterStatus) legacyHeater {
+	return legacyHeater{h.Setting, h.Watts, h.MaxWatts, onOff(h.Pump), onOff(h.Enabled)}
+}
+
+// Convert the current status to the original layout
+func buildLegacyResponse(s StatusResponse) legacyResponse {
+	l := legacyResponse{
+		Time: s.Time.String(),
+		Tesla: legacyTesla{
+			Mode:             s.Tesla.Mode,
+			MasterAddress:    s.Tesla.MasterAddress,
+			MaxAmps:          s.Tesla.MaxAmps,
+			AllocationPolicy: s.Tesla.AllocationPolicy,
+			Cars:             []legacyCar{},
+		},
+		Heater:    legacyHeaterFrom(s.Heater),
+		Diverters: []legacyDiverter{},
+		Pumps:     legacyPumps{SolarPump: s.Pumps.SolarPump},
+		Inverter: legacyInverter{
+			Frequency:   s.Inverter.FrequencyHz,
+			VSetpoint:   s.Inverter.SetpointVolts,
+			VBatt:       s.Inverter.BatteryVolts,
+			IBatt:       s.Inverter.BatteryAmps,
+			SOC:         s.Inverter.SOC,
+			legacyFlags: legacyFlags(s.Inverter.Flags),
+		},
+	}
+	for _, c := range s.Tesla.Cars {
+		l.Tesla.Cars = append(l.Tesla.Cars, legacyCar{
+			Address:      c.Address,
+			Current:      c.CurrentAmps,
+			MaxAmps:      c.AllowedAmps,
+			Priority:     c.Priority,
+			Status:       c.Status,
+			VIN:          c.VIN,
+			Rating:       c.RatingAmps,
+			Limit:        c.LimitAmps,
+			Minimum:      c.MinimumAmps,
+			SerialNumber: c.SerialNumber,
+			Firmware:     c.Firmware,
+			LifetimeKWh:  c.LifetimeKWh,
+			VoltsL1:      c.Volts[0],
+			VoltsL2:      c.Volts[1],
+			VoltsL3:      c.Volts[2],
+		})
+	}
+	for _, d := range s.Diverters {
+		ld := legacyDiverter{
+			Name:              d.Name,
+			Priority:          d.Priority,
+			legacyHeater:      legacyHeaterFrom(d.HeaterStatus),
+			Temperature:       d.Temperature,
+			TemperatureStale:  d.TemperatureStale,
+			TargetTemperature: d.TargetTemperature,
+			CutOffTemperature: d.CutOffTemperature,
+			BoostTemperature:  d.BoostTemperature,
+			Boosting:          d.Boosting,
+			LegionellaDue:     d.Legionella.Due,
+			LegionellaForcing: d.Legionella.Forcing,
+			Flow:              d.Flow,
+			WaitingForFlow:    d.WaitingForFlow,
+			Elements:          d.Elements,
+		}
+		if d.Legionella.LastCycle != nil {
+			ld.LegionellaLastCycle = d.Legionella.LastCycle.Format(time.RFC3339)
+		}
+		l.Diverters = append(l.Diverters, ld)
+	}
+	if s.Pumps.Fan != nil {
+		fan := onOff(s.Pumps.Fan.On)
+		l.Pumps.Fan = &fan
+	}
+	return l
+}
+
+func getValues(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, buildLegacyResponse(buildStatus()))
+}
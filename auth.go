@@ -0,0 +1,271 @@
+package main
+
+import (
+	"TeslaChargeControl/config"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Access control for the web API. Reading needs the read role and changing anything needs the operator role. Every
+// change goes through a POST so the method is enough to tell which role a request needs.
+
+const (
+	roleNone = iota
+	roleRead
+	roleOperator
+)
+
+var roleNames = map[string]int{"none": roleNone, "read": roleRead, "operator": roleOperator}
+
+type apiUser struct {
+	name     string
+	password [sha256.Size]byte // Hashed so comparisons take the same time whatever the length
+	token    [sha256.Size]byte
+	hasPass  bool
+	hasToken bool
+	role     int
+}
+
+type accessControl struct {
+	users         []apiUser
+	anonymousRole int
+	origins       map[string]bool
+	anyOrigin     bool
+	audit         *auditLog
+}
+
+// Build the access control from the API configuration. auditFile is used if the configuration doesn't give one.
+func newAccessControl(api config.API, auditFile string) (*accessControl, error) {
+	a := &accessControl{anonymousRole: roleRead, origins: make(map[string]bool)}
+	if api.AnonymousRole != "" {
+		role, found := roleNames[api.AnonymousRole]
+		if !found {
+			return nil, fmt.Errorf("unknown anonymous role %s - use read, operator or none", api.AnonymousRole)
+		}
+		a.anonymousRole = role
+	}
+	for _, u := range api.Users {
+		role, found := roleNames[u.Role]
+		if !found || (role == roleNone) {
+			return nil, fmt.Errorf("unknown role %s for user %s - use read or operator", u.Role, u.Name)
+		}
+		if (u.Password == "") && (u.Token == "") {
+			return nil, fmt.Errorf("user %s needs a password or a token", u.Name)
+		}
+		a.users = append(a.users, apiUser{
+			name:     u.Name,
+			password: sha256.Sum256([]byte(u.Password)),
+			token:    sha256.Sum256([]byte(u.Token)),
+			hasPass:  u.Password != "",
+			hasToken: u.Token != "",
+			role:     role,
+		})
+	}
+	for _, o := range api.CORSOrigins {
+		if o == "*" {
+			a.anyOrigin = true
+		} else {
+			a.origins[strings.TrimSuffix(o, "/")] = true
+		}
+	}
+	if api.AuditLog != "" {
+		auditFile = api.AuditLog
+	}
+	a.audit = &auditLog{path: auditFile}
+	if a.anonymousRole == roleOperator {
+		glog.Warning("Anyone can change the settings through the API. Set users and anonymousRole in the api configuration to stop this.")
+	}
+	return a, nil
+}
+
+// Find the user from a bearer token, a token query parameter or basic auth. Returns nil if no credentials were given.
+func (a *accessControl) authenticate(r *http.Request) (user *apiUser, err error) {
+	token := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if token != "" {
+		hash := sha256.Sum256([]byte(token))
+		for i := range a.users {
+			if a.users[i].hasToken && (subtle.ConstantTimeCompare(hash[:], a.users[i].token[:]) == 1) {
+				return &a.users[i], nil
+			}
+		}
+		return nil, fmt.Errorf("unknown token")
+	}
+	if name, password, ok := r.BasicAuth(); ok {
+		hash := sha256.Sum256([]byte(password))
+		for i := range a.users {
+			if a.users[i].hasPass && (a.users[i].name == name) && (subtle.ConstantTimeCompare(hash[:], a.users[i].password[:]) == 1) {
+				return &a.users[i], nil
+			}
+		}
+		return nil, fmt.Errorf("wrong name or password for %s", name)
+	}
+	return nil, nil
+}
+
+// True if a page from the request's origin may use the API. Requests from our own pages and from things other than
+// browsers don't have a different origin.
+func (a *accessControl) allowedOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if (origin == "") || a.anyOrigin || a.origins[origin] {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return (err == nil) && (u.Host == r.Host)
+}
+
+// Wrap the router with CORS, authentication, authorisation and the audit log
+func (a *accessControl) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); (origin != "") && a.allowedOrigin(r) {
+			if a.anyOrigin {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Add("Vary", "Origin")
+			}
+			if r.Method == http.MethodOptions {
+				// Preflight
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+				w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+				w.Header().Set("Access-Control-Max-Age", "600")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		} else if origin != "" {
+			writeError(w, http.StatusForbidden, fmt.Sprintf("Pages from %s may not use this API", origin))
+			return
+		}
+
+		user, err := a.authenticate(r)
+		if err != nil {
+			glog.Warningf("API authentication failed from %s - %s", r.RemoteAddr, err)
+			w.Header().Set("WWW-Authenticate", `Basic realm="TeslaChargeControl"`)
+			writeError(w, http.StatusUnauthorized, "Unknown user or token")
+			if (r.Method != http.MethodGet) && (r.Method != http.MethodHead) {
+				// Record attempted changes with bad credentials under the name they tried
+				name := "unknown"
+				if n, _, ok := r.BasicAuth(); ok {
+					name = n
+				}
+				a.audit.record(name, r, http.StatusUnauthorized)
+			}
+			return
+		}
+		role := a.anonymousRole
+		name := "anonymous"
+		if user != nil {
+			role = user.role
+			name = user.name
+		}
+		needed := roleRead
+		if (r.Method != http.MethodGet) && (r.Method != http.MethodHead) {
+			needed = roleOperator
+		}
+		if role < needed {
+			status := http.StatusForbidden
+			if user == nil {
+				status = http.StatusUnauthorized
+				w.Header().Set("WWW-Authenticate", `Basic realm="TeslaChargeControl"`)
+				writeError(w, status, "Please log in")
+			} else {
+				writeError(w, status, fmt.Sprintf("%s may not do that", name))
+			}
+			if needed == roleOperator {
+				// Record attempted changes as well
+				a.audit.record(name, r, status)
+			}
+			return
+		}
+		if needed == roleRead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		a.audit.record(name, r, rec.status)
+	})
+}
+
+// Keeps the status code so it can go in the audit log
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// One line of JSON for every change made through the API
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	User   string    `json:"user"`
+	Remote string    `json:"remote"`
+	Method string    `json:"method"`
+	Path   string    `json:"path"`
+	Query  string    `json:"query,omitempty"`
+	Status int       `json:"status"`
+}
+
+type auditLog struct {
+	path string
+	mu   sync.Mutex
+}
+
+func (l *auditLog) record(user string, r *http.Request, status int) {
+	remote := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	// Keep tokens out of the log
+	query := r.URL.Query()
+	query.Del("token")
+	e := auditEntry{Time: time.Now(), User: user, Remote: remote, Method: r.Method, Path: r.URL.Path, Query: query.Encode(), Status: status}
+	glog.Infof("API %s %s%s by %s from %s - %d", e.Method, e.Path, queryString(e.Query), e.User, e.Remote, e.Status)
+	b, err := json.Marshal(e)
+	if err != nil {
+		glog.Errorf("Failed to encode the audit log entry - %s", err)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err = os.MkdirAll(filepath.Dir(l.path), 0755)
+	if err != nil {
+		glog.Errorf("Failed to write to the audit log %s - %s", l.path, err)
+		return
+	}
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		glog.Errorf("Failed to write to the audit log %s - %s", l.path, err)
+		return
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	_, err = f.Write(append(b, '\n'))
+	if err != nil {
+		glog.Errorf("Failed to write to the audit log %s - %s", l.path, err)
+	}
+}
+
+func queryString(q string) string {
+	if q == "" {
+		return ""
+	}
+	return "?" + q
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"TeslaChargeControl/config"
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Every change and every attempt at one goes in the audit log, reads don't
+func TestAuditLog(t *testing.T) {
+	auditFile := filepath.Join(t.TempDir(), "audit.log")
+	api := config.API{
+		Users:         []config.User{{Name: "op", Password: "secret", Role: "operator"}, {Name: "viewer", Password: "look", Role: "read"}},
+		AnonymousRole: "read",
+	}
+	access, err := newAccessControl(api, auditFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := access.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		method   string
+		user     string
+		password string
+		status   int
+		audited  string // User in the audit log. Empty if it shouldn't be there
+	}{
+		{http.MethodGet, "", "", http.StatusOK, ""},
+		{http.MethodGet, "op", "wrong", http.StatusUnauthorized, ""},
+		{http.MethodPost, "op", "secret", http.StatusOK, "op"},
+		{http.MethodPost, "op", "wrong", http.StatusUnauthorized, "op"},
+		{http.MethodPost, "viewer", "look", http.StatusForbidden, "viewer"},
+		{http.MethodPost, "", "", http.StatusUnauthorized, "anonymous"},
+	}
+	var want []auditEntry
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "/api/v1/heater/enable", nil)
+		if test.user != "" {
+			r.SetBasicAuth(test.user, test.password)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s as %s/%s gave %d, want %d", test.method, test.user, test.password, w.Code, test.status)
+		}
+		if test.audited != "" {
+			want = append(want, auditEntry{User: test.audited, Method: test.method, Status: test.status})
+		}
+	}
+
+	f, err := os.Open(auditFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	var got []auditEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e auditEntry
+		err = json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, auditEntry{User: e.User, Method: e.Method, Status: e.Status})
+	}
+	if len(got) != len(want) {
+		t.Fatalf("audit log has %+v, want %+v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("audit entry %d is %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
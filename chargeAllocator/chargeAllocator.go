@@ -0,0 +1,282 @@
+package chargeAllocator
+
+import (
+	"TeslaChargeControl/twcSlave"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Allocation policies. Each one shares out the available current amongst the slaves that have a car asking to charge.
+//
+// equal      - Every car gets the same share up to its maximum. A car whose share is under its minimum doesn't charge.
+// roundRobin - Same as equal while there is enough for everybody. If not, as many cars as can get their minimum charge
+//              and the cars that miss out take their turn after each time slice.
+// priority   - Cars are filled to their maximum in priority order. Lower numbers come first.
+// fillFirst  - The car that started asking first is filled to its maximum before the next one gets anything.
+
+const (
+	PolicyEqual      = "equal"
+	PolicyRoundRobin = "roundRobin"
+	PolicyPriority   = "priority"
+	PolicyFillFirst  = "fillFirst"
+)
+
+const defaultMaxAmps = 4800        // Amps x 100. Used for a slave that has not told us its rating
+const defaultPriority = 1000       // Slaves without a priority go after those with one
+const TimeSlice = 15 * time.Minute // How long a car gets its turn in round robin before handing over
+
+type ChargeAllocator struct {
+	policy     string
+	priorities map[uint]int       // Priority by slave address. Lower numbers are filled first
+	arrivals   map[uint]time.Time // When each slave started asking for a charge
+	offset     int                // Round robin position
+	lastTurn   time.Time          // When the round robin position last moved
+	mu         sync.Mutex
+}
+
+func New() *ChargeAllocator {
+	a := new(ChargeAllocator)
+	a.policy = PolicyRoundRobin
+	a.priorities = make(map[uint]int)
+	a.arrivals = make(map[uint]time.Time)
+	a.lastTurn = time.Now()
+	return a
+}
+
+// Return the names of the policies that can be selected
+func GetPolicies() []string {
+	return []string{PolicyEqual, PolicyRoundRobin, PolicyPriority, PolicyFillFirst}
+}
+
+func (a *ChargeAllocator) GetPolicy() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.policy
+}
+
+func (a *ChargeAllocator) SetPolicy(policy string) error {
+	for _, p := range GetPolicies() {
+		if p == policy {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			a.policy = policy
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown allocation policy %s", policy)
+}
+
+func (a *ChargeAllocator) GetPriority(address uint) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.priority(address)
+}
+
+// Set the priority used by the priority policy. Lower numbers are filled first.
+func (a *ChargeAllocator) SetPriority(address uint, priority int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.priorities[address] = priority
+}
+
+// Share maxAmps (Amps x 100) amongst the slaves with a car asking to charge using the selected policy. Slaves in fixed
+// are given the current there (Amps x 100) instead and it comes out of maxAmps first.
+func (a *ChargeAllocator) Allocate(slaves []twcSlave.Slave, maxAmps int, fixed map[uint]int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// Cars with a fixed current get it first and the rest is shared
+	for i, s := range slaves {
+		if amps, found := fixed[s.GetAddress()]; found {
+			slaves[i].SetCurrent(amps)
+			if s.RequestCharge() {
+				maxAmps -= slaves[i].GetAllowed()
+			}
+		}
+	}
+	if maxAmps < 0 {
+		maxAmps = 0
+	}
+
+	// Find the cars waiting to charge, actively charging or starting to charge
+	var active []int
+	for i, s := range slaves {
+		if _, found := fixed[s.GetAddress()]; found {
+			continue
+		}
+		if s.RequestCharge() {
+			active = append(active, i)
+			if _, found := a.arrivals[s.GetAddress()]; !found {
+				a.arrivals[s.GetAddress()] = time.Now()
+			}
+		} else {
+			delete(a.arrivals, s.GetAddress())
+		}
+	}
+	if len(active) == 0 {
+		return
+	}
+	// Keep the order stable so round robin turns make sense
+	sort.Slice(active, func(i, j int) bool {
+		return slaves[active[i]].GetAddress() < slaves[active[j]].GetAddress()
+	})
+
+	limits := make([]limit, len(active))
+	for n, i := range active {
+		limits[n] = limit{slaves[i].GetMinimumCurrent(), slaves[i].GetCurrentLimit()}
+		if limits[n].max == 0 {
+			limits[n].max = defaultMaxAmps
+		}
+	}
+
+	var order []int
+	switch a.policy {
+	case PolicyPriority:
+		order = a.sorted(len(active), func(i, j int) bool {
+			return a.priority(slaves[active[i]].GetAddress()) < a.priority(slaves[active[j]].GetAddress())
+		})
+	case PolicyFillFirst:
+		order = a.sorted(len(active), func(i, j int) bool {
+			return a.arrivals[slaves[active[i]].GetAddress()].Before(a.arrivals[slaves[active[j]].GetAddress()])
+		})
+	}
+
+	var amps []int
+	switch a.policy {
+	case PolicyEqual:
+		amps = a.equal(limits, maxAmps)
+	case PolicyPriority, PolicyFillFirst:
+		amps = a.fill(limits, order, maxAmps)
+	default:
+		amps = a.roundRobin(limits, maxAmps)
+	}
+	for n, i := range active {
+		slaves[i].SetCurrent(amps[n])
+	}
+}
+
+// The least and most current a car can be given (Amps x 100)
+type limit struct {
+	min int
+	max int
+}
+
+// Return the positions 0..n-1 sorted using less
+func (a *ChargeAllocator) sorted(n int, less func(i, j int) bool) []int {
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return less(order[i], order[j])
+	})
+	return order
+}
+
+func (a *ChargeAllocator) priority(address uint) int {
+	if p, found := a.priorities[address]; found {
+		return p
+	}
+	return defaultPriority
+}
+
+// Divide the current between the cars equally without giving any car more than its maximum. Anything a car can't
+// use is shared amongst the others. A car whose share is less than its minimum gets nothing.
+func (a *ChargeAllocator) equal(limits []limit, maxAmps int) []int {
+	amps := share(limits, maxAmps)
+	for i, l := range limits {
+		if amps[i] < l.min {
+			amps[i] = 0
+		}
+	}
+	return amps
+}
+
+// Share maxAmps out equally capping each car at its maximum
+func share(limits []limit, maxAmps int) []int {
+	amps := make([]int, len(limits))
+	for maxAmps > 0 {
+		waiting := 0
+		for i, l := range limits {
+			if amps[i] < l.max {
+				waiting++
+			}
+		}
+		if (waiting == 0) || (maxAmps/waiting == 0) {
+			break
+		}
+		each := maxAmps / waiting
+		for i, l := range limits {
+			given := each
+			if amps[i]+given > l.max {
+				given = l.max - amps[i]
+			}
+			amps[i] += given
+			maxAmps -= given
+		}
+	}
+	return amps
+}
+
+// Share the current equally if everybody can get at least their minimum. Otherwise give it to as many cars as can
+// charge and move on to the next cars after each time slice.
+func (a *ChargeAllocator) roundRobin(limits []limit, maxAmps int) []int {
+	cars := len(limits)
+	amps := a.equal(limits, maxAmps)
+	everybody := true
+	for _, given := range amps {
+		everybody = everybody && (given > 0)
+	}
+	if everybody {
+		a.lastTurn = time.Now()
+		return amps
+	}
+	a.offset = a.offset % cars
+	// Take cars in turn until an equal share would no longer cover the largest minimum
+	var turn []limit
+	var positions []int
+	largest := 0
+	for n := 0; n < cars; n++ {
+		i := (a.offset + n) % cars
+		if limits[i].min > largest {
+			largest = limits[i].min
+		}
+		if maxAmps/(len(turn)+1) < largest {
+			break
+		}
+		turn = append(turn, limits[i])
+		positions = append(positions, i)
+	}
+	if time.Since(a.lastTurn) > TimeSlice {
+		// Hand over to the cars that missed out. Skip on if the next car's minimum was too much for us.
+		a.offset += len(positions)
+		if len(positions) == 0 {
+			a.offset++
+		}
+		a.lastTurn = time.Now()
+	}
+	amps = make([]int, cars)
+	for n, given := range a.equal(turn, maxAmps) {
+		amps[positions[n]] = given
+	}
+	return amps
+}
+
+// Fill each car to its maximum in the given order. Whatever is left goes to the next car if it covers its minimum.
+func (a *ChargeAllocator) fill(limits []limit, order []int, maxAmps int) []int {
+	amps := make([]int, len(limits))
+	for _, i := range order {
+		given := limits[i].max
+		if given > maxAmps {
+			given = maxAmps
+		}
+		if given < limits[i].min {
+			continue
+		}
+		amps[i] = given
+		maxAmps -= given
+	}
+	return amps
+}
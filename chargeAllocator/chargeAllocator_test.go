@@ -0,0 +1,76 @@
+package chargeAllocator
+
+import (
+	"TeslaChargeControl/twcMessage"
+	"TeslaChargeControl/twcSlave"
+	"testing"
+)
+
+type testCar struct {
+	address  uint
+	charging bool
+	minAmps  int
+	maxAmps  int
+	priority int
+}
+
+// Make a slave that has sent a heartbeat with the car charging or not
+func newSlave(c testCar) twcSlave.Slave {
+	s := twcSlave.New(c.address, false, nil)
+	s.SetLimits(c.minAmps, c.maxAmps)
+	msg := twcMessage.New(nil, false)
+	if c.charging {
+		msg.PutStatus(twcSlave.Status_Charging)
+	} else {
+		msg.PutStatus(twcSlave.Status_Ready)
+	}
+	s.UpdateValues(&msg)
+	return s
+}
+
+func TestAllocate(t *testing.T) {
+	charging := func(address uint) testCar { return testCar{address: address, charging: true} }
+	tests := []struct {
+		name    string
+		policy  string
+		cars    []testCar
+		maxAmps int
+		fixed   map[uint]int
+		want    []int
+	}{
+		{"equal", PolicyEqual, []testCar{charging(1), charging(2)}, 3200, nil, []int{1600, 1600}},
+		{"equal below the minimum", PolicyEqual, []testCar{charging(1), charging(2), charging(3)}, 1200, nil, []int{0, 0, 0}},
+		{"equal with a car at its maximum", PolicyEqual, []testCar{{1, true, 0, 1000, 0}, charging(2)}, 4000, nil, []int{1000, 3000}},
+		{"equal with a higher minimum", PolicyEqual, []testCar{{1, true, 2000, 0, 0}, charging(2)}, 3000, nil, []int{0, 1500}},
+		{"round robin", PolicyRoundRobin, []testCar{charging(1), charging(2), charging(3)}, 1200, nil, []int{600, 600, 0}},
+		{"priority", PolicyPriority, []testCar{{1, true, 0, 3200, 2}, {2, true, 0, 3200, 1}}, 4000, nil, []int{800, 3200}},
+		{"fill first", PolicyFillFirst, []testCar{{1, true, 0, 3200, 0}, {2, true, 0, 3200, 0}}, 4000, nil, []int{3200, 800}},
+		{"nothing to share", PolicyEqual, []testCar{charging(1), charging(2)}, 0, nil, []int{0, 0}},
+		{"fixed comes first", PolicyEqual, []testCar{charging(1), charging(2)}, 3000, map[uint]int{1: 1000}, []int{1000, 2000}},
+		{"fixed car not charging", PolicyEqual, []testCar{{address: 1}, charging(2)}, 3000, map[uint]int{1: 1000}, []int{1000, 3000}},
+		{"fixed at nothing", PolicyEqual, []testCar{charging(1), charging(2)}, 3000, map[uint]int{1: 0}, []int{0, 3000}},
+		{"fixed takes everything", PolicyEqual, []testCar{charging(1), charging(2)}, 1000, map[uint]int{1: 1600}, []int{1600, 0}},
+		{"fixed over its maximum", PolicyEqual, []testCar{{1, true, 0, 1000, 0}, charging(2)}, 3000, map[uint]int{1: 1600}, []int{1000, 2000}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := New()
+			if err := a.SetPolicy(test.policy); err != nil {
+				t.Fatal(err)
+			}
+			var slaves []twcSlave.Slave
+			for _, c := range test.cars {
+				slaves = append(slaves, newSlave(c))
+				if c.priority > 0 {
+					a.SetPriority(c.address, c.priority)
+				}
+			}
+			a.Allocate(slaves, test.maxAmps, test.fixed)
+			for i, s := range slaves {
+				if got := s.GetAllowed(); got != test.want[i] {
+					t.Errorf("car %d allowed %d, want %d", s.GetAddress(), got, test.want[i])
+				}
+			}
+		})
+	}
+}
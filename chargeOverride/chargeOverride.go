@@ -0,0 +1,198 @@
+package chargeOverride
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"sync"
+	"time"
+)
+
+// Manual overrides of the current the cars are given. Normally the cars get whatever the power calculation says is
+// spare. An override replaces that for a while.
+//
+// auto      - No override. The power calculation decides.
+// manual    - Share a fixed current between the cars.
+// paused    - Give the cars nothing.
+// chargeNow - Give the cars everything the wiring allows whatever the solar is doing.
+//
+// A single car can also be given a fixed current. It is left out when the rest is shared.
+// Overrides lapse back to auto when they expire.
+//
+// None of this gets past the safety cut-offs. The cars get nothing while the power must not be used, such as while
+// the generator runs, and never more than the wiring allows between them.
+
+const (
+	ModeAuto      = "auto"
+	ModeManual    = "manual"
+	ModePaused    = "paused"
+	ModeChargeNow = "chargeNow"
+)
+
+// How long an override lasts if no time is given
+const DefaultDuration = 2 * time.Hour
+
+type Override struct {
+	Mode    string    // One of the modes above. Car overrides are always manual
+	Amps    float32   // Current for manual overrides
+	Expires time.Time // Zero if the override lasts until it is cleared
+}
+
+type Overrides struct {
+	global Override
+	cars   map[uint]Override // By TWC address
+	mu     sync.Mutex
+}
+
+func New() *Overrides {
+	return &Overrides{global: Override{Mode: ModeAuto}, cars: make(map[uint]Override)}
+}
+
+func expiry(duration time.Duration) time.Time {
+	if duration <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(duration)
+}
+
+func (o Override) expired() bool {
+	return !o.Expires.IsZero() && time.Now().After(o.Expires)
+}
+
+// Set the mode for all the cars. amps is only used by manual. A duration of 0 or less never expires.
+func (o *Overrides) SetMode(mode string, amps float32, duration time.Duration) error {
+	switch mode {
+	case ModeAuto:
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		o.global = Override{Mode: ModeAuto}
+		glog.Info("Charging is back to automatic")
+		return nil
+	case ModeManual:
+		if amps < 0 {
+			return fmt.Errorf("the charge current can't be negative")
+		}
+	case ModePaused, ModeChargeNow:
+		amps = 0
+	default:
+		return fmt.Errorf("unknown charging mode %s", mode)
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.global = Override{Mode: mode, Amps: amps, Expires: expiry(duration)}
+	if mode == ModeManual {
+		glog.Infof("Charging set to %0.1fA until %s", amps, describeExpiry(o.global.Expires))
+	} else {
+		glog.Infof("Charging set to %s until %s", mode, describeExpiry(o.global.Expires))
+	}
+	return nil
+}
+
+// Give one car a fixed current
+func (o *Overrides) SetCar(address uint, amps float32, duration time.Duration) error {
+	if amps < 0 {
+		return fmt.Errorf("the charge current can't be negative")
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.cars[address] = Override{Mode: ModeManual, Amps: amps, Expires: expiry(duration)}
+	glog.Infof("Charging for %04x set to %0.1fA until %s", address, amps, describeExpiry(o.cars[address].Expires))
+	return nil
+}
+
+// Put one car back to sharing the current with the others
+func (o *Overrides) ClearCar(address uint) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, found := o.cars[address]; found {
+		delete(o.cars, address)
+		glog.Infof("Charging for %04x is back to automatic", address)
+	}
+}
+
+// Clear every override
+func (o *Overrides) Clear() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.global = Override{Mode: ModeAuto}
+	o.cars = make(map[uint]Override)
+	glog.Info("All charging overrides cleared")
+}
+
+func describeExpiry(t time.Time) string {
+	if t.IsZero() {
+		return "cleared"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// Drop expired overrides. Must be called with the lock held.
+func (o *Overrides) expire() {
+	if (o.global.Mode != ModeAuto) && o.global.expired() {
+		glog.Infof("Charging override %s has expired. Back to automatic", o.global.Mode)
+		o.global = Override{Mode: ModeAuto}
+	}
+	for address, c := range o.cars {
+		if c.expired() {
+			glog.Infof("Charging override for %04x has expired. Back to automatic", address)
+			delete(o.cars, address)
+		}
+	}
+}
+
+// Return the override for all the cars
+func (o *Overrides) Get() Override {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.expire()
+	return o.global
+}
+
+// Return the override for one car. found is false if it doesn't have one.
+func (o *Overrides) GetCar(address uint) (override Override, found bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.expire()
+	override, found = o.cars[address]
+	return override, found
+}
+
+// Work out the current to share between the cars (Amps x 100) and the fixed current for any cars with their own
+// override. automatic is what the power calculation has made available and systemMax is the most the wiring allows.
+// Cars with their own override come out of the shared current unless the cars are paused. If forcedOff is set every
+// car gets nothing whatever the overrides say. Fixed currents that add up to more than systemMax are scaled down.
+func (o *Overrides) Apply(automatic int, systemMax int, forcedOff bool) (shared int, fixed map[uint]int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.expire()
+	switch {
+	case forcedOff:
+		shared = 0
+	case o.global.Mode == ModeManual:
+		shared = int(o.global.Amps * 100)
+	case o.global.Mode == ModePaused:
+		shared = 0
+	case o.global.Mode == ModeChargeNow:
+		shared = systemMax
+	default:
+		shared = automatic
+	}
+	if shared > systemMax {
+		shared = systemMax
+	}
+	fixed = make(map[uint]int)
+	total := 0
+	for address, c := range o.cars {
+		amps := int(c.Amps * 100)
+		if forcedOff || (o.global.Mode == ModePaused) {
+			amps = 0
+		}
+		fixed[address] = amps
+		total += amps
+	}
+	if total > systemMax {
+		for address, amps := range fixed {
+			fixed[address] = amps * systemMax / total
+		}
+	}
+	return shared, fixed
+}
@@ -0,0 +1,58 @@
+package chargeOverride
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApply(t *testing.T) {
+	type car struct {
+		address uint
+		amps    float32
+	}
+	tests := []struct {
+		name       string
+		mode       string
+		amps       float32
+		cars       []car
+		automatic  int
+		systemMax  int
+		forcedOff  bool
+		wantShared int
+		wantFixed  map[uint]int
+	}{
+		{"auto", ModeAuto, 0, nil, 2000, 8000, false, 2000, map[uint]int{}},
+		{"auto over the wiring", ModeAuto, 0, nil, 9000, 8000, false, 8000, map[uint]int{}},
+		{"manual", ModeManual, 16, nil, 2000, 8000, false, 1600, map[uint]int{}},
+		{"manual over the wiring", ModeManual, 100, nil, 2000, 8000, false, 8000, map[uint]int{}},
+		{"paused", ModePaused, 0, []car{{1, 10}}, 2000, 8000, false, 0, map[uint]int{1: 0}},
+		{"charge now", ModeChargeNow, 0, nil, 0, 8000, false, 8000, map[uint]int{}},
+		{"car override", ModeAuto, 0, []car{{1, 10}, {2, 16}}, 2000, 8000, false, 2000, map[uint]int{1: 1000, 2: 1600}},
+		{"car overrides over the wiring", ModeAuto, 0, []car{{1, 30}, {2, 50}}, 0, 4000, false, 0, map[uint]int{1: 1500, 2: 2500}},
+		{"generator with auto", ModeAuto, 0, nil, 2000, 8000, true, 0, map[uint]int{}},
+		{"generator with manual", ModeManual, 16, nil, 2000, 8000, true, 0, map[uint]int{}},
+		{"generator with charge now", ModeChargeNow, 0, []car{{1, 10}}, 0, 8000, true, 0, map[uint]int{1: 0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			o := New()
+			if test.mode != ModeAuto {
+				if err := o.SetMode(test.mode, test.amps, 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, c := range test.cars {
+				if err := o.SetCar(c.address, c.amps, 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+			shared, fixed := o.Apply(test.automatic, test.systemMax, test.forcedOff)
+			if shared != test.wantShared {
+				t.Errorf("shared %d, want %d", shared, test.wantShared)
+			}
+			if !reflect.DeepEqual(fixed, test.wantFixed) {
+				t.Errorf("fixed %v, want %v", fixed, test.wantFixed)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"TeslaChargeControl/twcSimulator"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Runs simulated Wall Connectors on a pseudo terminal. Start the controller with -a set to the port name printed.
+
+func main() {
+	var chargers int
+	var protocol int
+	var maxAmps float64
+	var plugIn bool
+
+	flag.IntVar(&chargers, "n", 2, "Number of chargers to simulate")
+	flag.IntVar(&protocol, "v", 2, "TWC protocol version (1 or 2)")
+	flag.Float64Var(&maxAmps, "m", 48, "Charger rating in Amps")
+	flag.BoolVar(&plugIn, "p", true, "Plug a car into each charger")
+	flag.Parse()
+
+	var list []*twcSimulator.Charger
+	for i := 0; i < chargers; i++ {
+		c := twcSimulator.NewCharger(uint(0x1000+i), protocol, int(maxAmps*100), fmt.Sprintf("SIM%08d", i))
+		if plugIn {
+			c.PlugIn(fmt.Sprintf("5YJ3E1EA0KF%06d", i), 4800)
+		}
+		list = append(list, c)
+	}
+	sim, err := twcSimulator.New(list...)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Failed to start the simulator - %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Simulating %d chargers on %s\n", chargers, sim.GetPortName())
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	_ = sim.Close()
+}
@@ -0,0 +1,202 @@
+package config
+
+import (
+	"TeslaChargeControl/diverters"
+	"TeslaChargeControl/heaterSetting"
+	"TeslaChargeControl/pumpControl"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// Settings loaded from the JSON configuration file
+//
+// Example:
+//
+//	{
+//		"chargers": {
+//			"1a2b": { "maxAmps": 32, "minAmps": 6 },
+//			"3c4d": { "maxAmps": 48 }
+//		},
+//		"heater": {
+//			"elements": [
+//				{ "pin": 6, "watts": 2500 },
+//				{ "pin": 24, "watts": 6000, "activeLow": true }
+//			],
+//			"pumpPin": 23,
+//			"pumpActiveHigh": false,
+//			"pumpRunOnSeconds": 30,
+//			"confirmFlow": true, "flowPin": 27, "flowActiveHigh": true, "flowWaitSeconds": 60,
+//			"maxTemp": 950, "targetTemp": 650, "hysteresis": 50, "boostTemp": 400, "boostWatts": 2500,
+//			"legionella": { "temp": 600, "intervalDays": 7, "startHour": 13, "windowHours": 4 },
+//			"temperature": { "type": "ds18b20", "devices": [ "28-0316a2795aff" ], "maxAgeSeconds": 60 }
+//		},
+//		"diverters": [
+//			{ "name": "pool", "priority": 2, "elements": [ { "pin": 5, "watts": 3000 } ], "noPump": true, "noTempLimit": true },
+//			{ "name": "tank2", "priority": 1, "elements": [ { "pin": 12, "watts": 3000 } ], "noPump": true,
+//				"temperature": { "type": "mqtt", "url": "tcp://127.0.0.1:1883", "topic": "tank2/temperature" } }
+//		],
+//		"solarPump": { "pin": 18, "inverted": true, "collector": { "type": "ds18b20", "devices": [ "28-0316a27a11ff" ] } },
+//		"fan": { "pin": 17, "activeHigh": true, "runOnSeconds": 120 },
+//		"api": { "address": "0.0.0.0", "port": 8443, "certFile": "/etc/ssl/tcc.pem", "keyFile": "/etc/ssl/tcc.key",
+//			"unixSocket": "/run/TeslaChargeControl.sock", "corsOrigins": [ "https://dashboard.lan" ],
+//			"users": [
+//				{ "name": "ian", "password": "secret", "role": "operator" },
+//				{ "name": "wallDisplay", "token": "6f1c0e9a4b7d", "role": "read" }
+//			] }
+//	}
+//
+// "heater" describes the original hot water tank. "diverters" lists any other loads surplus power can go to.
+// Lower priority numbers get surplus first. The hot water tank is named hotTank and has priority 0 unless it is
+// given in "diverters" instead.
+//
+// "temperature" says where a heater reads its tank temperature. Types are sql, ds18b20, http and mqtt. The hot water
+// tank reads the solar controller's sensors from the database if it is not given. Any other diverter without one
+// must set "noTempLimit" or the configuration is rejected.
+//
+// Temperatures are Deg C x 10. Surplus power heats the tank to "targetTemp" and nothing heats it past "maxTemp". Once
+// either is reached the heater stays off until the tank cools by "hysteresis". Below "boostTemp" the tank is heated
+// to "targetTemp" with up to "boostWatts" even if that means drawing from the battery or grid.
+//
+// "legionella" makes sure the tank reaches "temp" at least once every "intervalDays". Surplus power may heat the tank
+// past "targetTemp" while a cycle is due. If that isn't enough the tank is heated as for a boost during the window of
+// "windowHours" starting at "startHour" each day. The last successful cycle is kept in <state directory>/<name>-legionella.json
+// unless "stateFile" is given.
+//
+// "confirmFlow" on a heater keeps its elements off unless the flow switch on "flowPin" shows the pump is moving water.
+// If there is no flow within "flowWaitSeconds" the pump is stopped and left off for the same time before it is tried
+// again.
+// "solarPump" runs the collector pump at a speed set by how much hotter the collector is than the tank. The tank
+// temperature is taken from the hot water tank heater unless "tank" is given. "fan" cools the heater relays.
+//
+// Each heater's element run times, switch counts and energy are kept in <state directory>/<name>-elements.json unless
+// "elementStateFile" is given. Elements of equal power take turns by run time.
+//
+// "api" sets where the web API listens. It listens on every interface on the port given by -i (default 8080) unless
+// "address" or "port" are given. With "certFile" and "keyFile" it serves HTTPS instead of HTTP. Giving only one of
+// them stops the program. "unixSocket" also serves plain HTTP on a Unix socket for a local reverse proxy. Only its
+// owner and group may connect. "noTCP" turns off the network listener.
+//
+// "users" log in with HTTP basic auth using "name" and "password" or send "token" as "Authorization: Bearer <token>"
+// (or ?token=<token> for event streams). The read role can only GET. The operator role can also POST the changes.
+// Requests without credentials get "anonymousRole", which is read unless set to operator or none. Browser pages
+// from other sites can only use the API if their origin is in "corsOrigins" ("*" for any). Every change is
+// written to <state directory>/audit.log unless "auditLog" is given.
+
+// Limits for one Tesla Wall Connector. Zero means use the default.
+type Charger struct {
+	MaxAmps float32 `json:"maxAmps"` // Never allow more than this. Set to suit the breaker feeding the charger
+	MinAmps float32 `json:"minAmps"` // Don't charge at all if we can't give at least this much
+}
+
+type Config struct {
+	Chargers  map[string]Charger           `json:"chargers"`  // Keyed by TWC address in hex as shown in the logs
+	Heater    *heaterSetting.Config        `json:"heater"`    // Leave out to use the original wiring
+	Diverters []Diverter                   `json:"diverters"` // Other loads to send surplus power to
+	SolarPump *pumpControl.SolarPumpConfig `json:"solarPump"` // Leave out if there is no solar collector pump
+	Fan       *pumpControl.FanConfig       `json:"fan"`       // Leave out if there is no cooling fan
+	API       API                          `json:"api"`
+}
+
+// Where the web API listens
+type API struct {
+	Address    string `json:"address"`    // Interface to listen on. Default all of them
+	Port       int    `json:"port"`       // Default is the -i flag
+	CertFile   string `json:"certFile"`   // TLS certificate. Serve HTTPS if this and KeyFile are given
+	KeyFile    string `json:"keyFile"`    // TLS private key
+	UnixSocket string `json:"unixSocket"` // Also listen on this Unix socket
+	NoTCP      bool   `json:"noTCP"`      // Only listen on the Unix socket
+	// Access control
+	Users         []User   `json:"users"`
+	AnonymousRole string   `json:"anonymousRole"` // Role for requests without credentials. Default read
+	CORSOrigins   []string `json:"corsOrigins"`   // Other sites whose pages may use the API
+	AuditLog      string   `json:"auditLog"`      // Where changes are recorded
+}
+
+// Someone allowed to use the API. Give a password, a token or both.
+type User struct {
+	Name     string `json:"name"`
+	Password string `json:"password"` // For HTTP basic auth
+	Token    string `json:"token"`    // For bearer auth
+	Role     string `json:"role"`     // read or operator
+}
+
+// True if the API should be served over HTTPS
+func (a API) UseTLS() bool {
+	return (a.CertFile != "") && (a.KeyFile != "")
+}
+
+// A load surplus power can be sent to
+type Diverter struct {
+	Name     string `json:"name"`
+	Priority int    `json:"priority"` // Lower numbers get surplus power first
+	heaterSetting.Config
+}
+
+// Read the configuration from the given file. A missing file gives an empty configuration.
+func Load(path string) (*Config, error) {
+	c := new(Config)
+	c.Chargers = make(map[string]Charger)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	err = json.NewDecoder(f).Decode(c)
+	if err != nil {
+		return nil, err
+	}
+	// A diverter without a temperature would never be turned on
+	for _, d := range c.GetDiverters() {
+		if (d.GetTemperature() == nil) && !d.NoTempLimit {
+			return nil, fmt.Errorf("diverter %s needs a temperature or noTempLimit", d.Name)
+		}
+	}
+	return c, nil
+}
+
+// Return the limits for the charger at the given address. found is false if it is not configured.
+func (c *Config) GetCharger(address uint) (charger Charger, found bool) {
+	for key, ch := range c.Chargers {
+		a, err := strconv.ParseUint(key, 16, 16)
+		if err == nil && uint(a) == address {
+			return ch, true
+		}
+	}
+	return Charger{}, false
+}
+
+// Return the heater wiring from the configuration or the original wiring if there is none
+func (c *Config) GetHeater() heaterSetting.Config {
+	if c.Heater == nil {
+		return heaterSetting.DefaultConfig()
+	}
+	return *c.Heater
+}
+
+// Return every diverter including the hot water tank
+func (c *Config) GetDiverters() []Diverter {
+	for _, d := range c.Diverters {
+		if d.Name == diverters.HotTank {
+			return c.Diverters
+		}
+	}
+	return append([]Diverter{{Name: diverters.HotTank, Priority: 0, Config: c.GetHeater()}}, c.Diverters...)
+}
+
+// Return where the diverter gets its temperature from or nil if it doesn't have one
+func (d Diverter) GetTemperature() *heaterSetting.TemperatureConfig {
+	if d.Temperature != nil {
+		return d.Temperature
+	}
+	if d.Name == diverters.HotTank && !d.NoTempLimit {
+		t := heaterSetting.DefaultTemperatureConfig()
+		return &t
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadDiverterTemperature(t *testing.T) {
+	tests := []struct {
+		name   string
+		json   string
+		wantOK bool
+	}{
+		{"default hot tank", `{}`, true},
+		{"temperature", `{"diverters": [{"name": "tank2", "temperature": {"type": "mqtt", "topic": "tank2/temperature"}}]}`, true},
+		{"no temperature limit", `{"diverters": [{"name": "pool", "noTempLimit": true}]}`, true},
+		{"no temperature", `{"diverters": [{"name": "pool"}]}`, false},
+	}
+	dir := t.TempDir()
+	for _, test := range tests {
+		path := filepath.Join(dir, "config.json")
+		err := os.WriteFile(path, []byte(test.json), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = Load(path)
+		if (err == nil) != test.wantOK {
+			t.Errorf("%s: Load gave error %v, want ok %v", test.name, err, test.wantOK)
+		}
+	}
+}
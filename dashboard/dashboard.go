@@ -0,0 +1,17 @@
+package dashboard
+
+import (
+	"embed"
+	"net/http"
+)
+
+// A single page dashboard built into the program so nothing else has to serve it. It reads everything from the
+// /api/v1 endpoints. Live values come from the event stream and the charts from the history kept in memory.
+
+//go:embed index.html dashboard.css dashboard.js
+var files embed.FS
+
+// Serve the dashboard files. Mount it with the path prefix stripped.
+func Handler() http.Handler {
+	return http.FileServer(http.FS(files))
+}
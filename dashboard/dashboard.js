@@ -0,0 +1,322 @@
+"use strict";
+
+// Live values come from the event stream. The charts start from /api/v1/history and grow with each history event.
+
+const api = "/api/v1";
+const day = 24 * 60 * 60 * 1000;
+let readings = [];
+
+function $(id) {
+	return document.getElementById(id);
+}
+
+function format(value, digits, units) {
+	if ((value === null) || (value === undefined)) {
+		return "–";
+	}
+	return value.toFixed(digits) + units;
+}
+
+function make(tag, className, text) {
+	const e = document.createElement(tag);
+	if (className) {
+		e.className = className;
+	}
+	if (text !== undefined) {
+		e.textContent = text;
+	}
+	return e;
+}
+
+function showInverter(inverter) {
+	$("frequency").textContent = format(inverter.frequencyHz, 2, " Hz");
+	$("soc").textContent = format(inverter.soc, 1, " %");
+	// Positive battery current is discharging
+	const amps = inverter.batteryAmps;
+	$("battery").textContent = format(Math.abs(amps), 1, " A");
+	$("batteryDetail").textContent = (amps > 0.5 ? "Discharging" : amps < -0.5 ? "Charging" : "Idle") +
+		" at " + format(inverter.batteryVolts, 1, " V");
+}
+
+function showTesla(tesla) {
+	$("cars").textContent = format(tesla.currentAmps, 1, " A");
+	$("carsDetail").textContent = format(tesla.maxAmps, 1, " A") + " available";
+	const rows = $("chargerRows");
+	rows.replaceChildren();
+	for (const car of tesla.cars) {
+		const row = make("tr");
+		row.append(make("td", "", car.address), make("td", "", car.status),
+			make("td", "", format(car.currentAmps, 1, " A")), make("td", "", format(car.allowedAmps, 1, " A")),
+			make("td", "", format(car.limitAmps, 1, " A")), make("td", "", car.vin || ""));
+		rows.append(row);
+	}
+	if (tesla.cars.length === 0) {
+		const row = make("tr");
+		const cell = make("td", "", "No chargers");
+		cell.colSpan = 6;
+		row.append(cell);
+		rows.append(row);
+	}
+	const o = tesla.override;
+	let text = "";
+	if (o && (o.mode !== "auto")) {
+		text = "Charging override: " + (o.mode === "manual" ? format(o.amps, 1, " A") : o.mode) +
+			(o.expires ? " until " + new Date(o.expires).toLocaleTimeString() : "");
+	}
+	$("override").textContent = text;
+}
+
+function showDiverters(diverters) {
+	let watts = 0;
+	const list = $("diverters");
+	list.replaceChildren();
+	for (const d of diverters) {
+		watts += d.watts;
+		const box = make("div", "diverter");
+		const title = make("h3", "", d.name + " ");
+		title.append(make("span", d.enabled ? "" : "disabled", d.enabled ? "enabled" : "disabled"));
+		const action = d.enabled ? "disable" : "enable";
+		const button = make("button", "", d.enabled ? "Disable" : "Enable");
+		button.dataset.action = "diverters/" + encodeURIComponent(d.name) + "/" + action;
+		title.append(button);
+		box.append(title);
+
+		let detail = format(d.watts, 0, " W") + " of " + format(d.maxWatts, 0, " W");
+		if (d.temperature) {
+			detail += " · " + (d.temperatureStale ? "temperature unknown" : format(d.temperature, 1, " °C")) +
+				" target " + format(d.targetTemperature, 1, " °C");
+		}
+		if (d.boosting) {
+			detail += " · boosting";
+		}
+		if (d.legionella && d.legionella.forcing) {
+			detail += " · legionella cycle";
+		}
+		if (d.waitingForFlow) {
+			detail += " · waiting for flow";
+		}
+		box.append(make("div", "detail", detail));
+
+		const elements = make("div", "elements");
+		for (const e of d.elements || []) {
+			const chip = make("span", e.on ? "element on" : "element", "Pin " + e.pin + " " + e.watts + " W");
+			chip.title = format(e.onSeconds / 3600, 1, " h") + " · " + e.cycles + " starts · " + format(e.kWh, 1, " kWh");
+			elements.append(chip);
+		}
+		box.append(elements);
+		list.append(box);
+
+		if (d.name === "hotTank") {
+			$("tank").textContent = d.temperatureStale ? "–" : format(d.temperature, 1, " °C");
+			$("tankDetail").textContent = d.temperatureStale ? "Temperature unknown" : "Target " + format(d.targetTemperature, 1, " °C");
+		}
+	}
+	$("diverterWatts").textContent = format(watts / 1000, 2, " kW");
+}
+
+function showStatus(status) {
+	showInverter(status.inverter);
+	showTesla(status.tesla);
+	showDiverters(status.diverters);
+}
+
+// Changes are POSTs. The browser asks for a login if the API wants one.
+async function act(action) {
+	$("error").textContent = "";
+	try {
+		const response = await fetch(api + "/" + action, {method: "POST", credentials: "same-origin"});
+		const body = await response.json();
+		if (!response.ok) {
+			$("error").textContent = body.error || response.statusText;
+			return;
+		}
+		showStatus(body);
+	} catch (err) {
+		$("error").textContent = err.message;
+	}
+}
+
+document.addEventListener("click", (event) => {
+	const action = event.target.dataset && event.target.dataset.action;
+	if (action) {
+		act(action);
+	}
+});
+
+// A simple line chart. series is a list of {label, colour, value(sample)}. Missing values leave a gap.
+function drawChart(canvas, series) {
+	const ratio = window.devicePixelRatio || 1;
+	const width = canvas.clientWidth;
+	const height = canvas.clientHeight;
+	canvas.width = width * ratio;
+	canvas.height = height * ratio;
+	const ctx = canvas.getContext("2d");
+	ctx.scale(ratio, ratio);
+	ctx.clearRect(0, 0, width, height);
+
+	const end = Date.now();
+	const start = end - day;
+	let min = Infinity;
+	let max = -Infinity;
+	for (const s of series) {
+		for (const sample of readings) {
+			const v = s.value(sample);
+			if ((v !== null) && (v !== undefined)) {
+				min = Math.min(min, v);
+				max = Math.max(max, v);
+			}
+		}
+	}
+	ctx.font = "11px system-ui, sans-serif";
+	ctx.fillStyle = "#667";
+	if (min === Infinity) {
+		ctx.fillText("No readings yet", 40, height / 2);
+		return;
+	}
+	if (max - min < 0.001) {
+		min -= 1;
+		max += 1;
+	}
+	const pad = (max - min) * 0.1;
+	min -= pad;
+	max += pad;
+
+	const left = 40;
+	const bottom = height - 16;
+	const x = (t) => left + (t - start) / (end - start) * (width - left);
+	const y = (v) => bottom - (v - min) / (max - min) * (bottom - 4);
+
+	// Grid with a label at each line
+	ctx.strokeStyle = "#e3e5e8";
+	ctx.lineWidth = 1;
+	for (let i = 0; i <= 4; i++) {
+		const v = min + (max - min) * i / 4;
+		ctx.beginPath();
+		ctx.moveTo(left, y(v));
+		ctx.lineTo(width, y(v));
+		ctx.stroke();
+		ctx.fillText(v.toFixed(Math.abs(max - min) < 10 ? 1 : 0), 0, y(v) + 4);
+	}
+	for (let h = 24; h >= 0; h -= 6) {
+		const t = end - h * 3600 * 1000;
+		ctx.fillText(new Date(t).toLocaleTimeString([], {hour: "2-digit", minute: "2-digit"}), Math.min(x(t) - 14, width - 30), height - 2);
+	}
+
+	ctx.lineWidth = 1.5;
+	for (const s of series) {
+		ctx.strokeStyle = s.colour;
+		ctx.beginPath();
+		let drawing = false;
+		for (const sample of readings) {
+			const v = s.value(sample);
+			const t = new Date(sample.time).getTime();
+			if ((v === null) || (v === undefined) || (t < start)) {
+				drawing = false;
+				continue;
+			}
+			if (drawing) {
+				ctx.lineTo(x(t), y(v));
+			} else {
+				ctx.moveTo(x(t), y(v));
+				drawing = true;
+			}
+		}
+		ctx.stroke();
+	}
+}
+
+const currentSeries = [
+	{label: "Battery", colour: "#2b7bb9", value: (s) => s.batteryAmps},
+	{label: "Cars", colour: "#c0392b", value: (s) => s.carAmps},
+	{label: "Available", colour: "#27ae60", value: (s) => s.availableAmps},
+];
+
+const tankColours = ["#c0392b", "#2b7bb9", "#27ae60", "#8e44ad", "#f5a623"];
+
+// One line for each diverter that has reported a temperature
+function tankSeries() {
+	const names = [];
+	for (const sample of readings) {
+		for (const name of Object.keys(sample.temperatures || {})) {
+			if (!names.includes(name)) {
+				names.push(name);
+			}
+		}
+	}
+	names.sort();
+	return names.map((name, i) => ({
+		label: name,
+		colour: tankColours[i % tankColours.length],
+		value: (s) => s.temperatures && s.temperatures[name],
+	}));
+}
+
+function showLegend(legend, series) {
+	legend.replaceChildren();
+	for (const s of series) {
+		const key = make("span", "", "— " + s.label);
+		key.style.color = s.colour;
+		legend.append(key);
+	}
+}
+
+function drawCharts() {
+	drawChart($("frequencyChart"), [{colour: "#8e44ad", value: (s) => s.frequencyHz}]);
+	drawChart($("socChart"), [{colour: "#27ae60", value: (s) => s.soc}]);
+	drawChart($("currentChart"), currentSeries);
+	drawChart($("diverterChart"), [{colour: "#f5a623", value: (s) => s.diverterWatts / 1000}]);
+	const tanks = tankSeries();
+	drawChart($("tankChart"), tanks);
+	showLegend($("tankLegend"), tanks);
+}
+
+function addHistory(sample) {
+	// New streams start with the latest sample which we may already have
+	const last = readings[readings.length - 1];
+	if (last && (new Date(sample.time) <= new Date(last.time))) {
+		return;
+	}
+	readings.push(sample);
+	const oldest = Date.now() - day;
+	while ((readings.length > 0) && (new Date(readings[0].time).getTime() < oldest)) {
+		readings.shift();
+	}
+	drawCharts();
+}
+
+function connect() {
+	const events = new EventSource(api + "/stream?interval=1s&events=inverter,tesla,diverters,history");
+	const data = (event) => JSON.parse(event.data).data;
+	events.onopen = () => {
+		$("connection").textContent = "Live";
+		$("connection").className = "connection live";
+	};
+	events.onerror = () => {
+		// The browser reconnects by itself
+		$("connection").textContent = "Reconnecting…";
+		$("connection").className = "connection down";
+	};
+	events.addEventListener("inverter", (event) => showInverter(data(event)));
+	events.addEventListener("tesla", (event) => showTesla(data(event)));
+	events.addEventListener("diverters", (event) => showDiverters(data(event)));
+	events.addEventListener("history", (event) => addHistory(data(event)));
+}
+
+async function start() {
+	showLegend($("currentLegend"), currentSeries);
+	try {
+		const [status, samples] = await Promise.all([
+			fetch(api + "/status", {credentials: "same-origin"}).then((r) => r.json()),
+			fetch(api + "/history", {credentials: "same-origin"}).then((r) => r.json()),
+		]);
+		showStatus(status);
+		readings = samples;
+	} catch (err) {
+		$("error").textContent = err.message;
+	}
+	drawCharts();
+	connect();
+	window.addEventListener("resize", drawCharts);
+}
+
+start();
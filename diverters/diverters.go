@@ -0,0 +1,130 @@
+package diverters
+
+import (
+	"TeslaChargeControl/heaterSetting"
+	"sort"
+	"sync"
+)
+
+// Keeps track of every load we can dump surplus power into (water tanks, pool heater, space heater relays...)
+// Surplus goes to the diverter with the lowest priority number first. When power is short the diverter with the
+// highest priority number is turned down first.
+
+// Name of the original hot water tank. It gets the hot tank temperature from the database unless configured otherwise.
+const HotTank = "hotTank"
+
+type Diverter struct {
+	Name     string
+	Priority int
+	Heater   *heaterSetting.HeaterSetting
+}
+
+type Registry struct {
+	diverters []*Diverter // In priority order
+	mu        sync.Mutex
+}
+
+func New() *Registry {
+	return new(Registry)
+}
+
+// Add a diverter. Diverters with the same priority are used in the order they were added.
+func (r *Registry) Add(name string, priority int, heater *heaterSetting.HeaterSetting) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.diverters = append(r.diverters, &Diverter{name, priority, heater})
+	sort.SliceStable(r.diverters, func(i, j int) bool {
+		return r.diverters[i].Priority < r.diverters[j].Priority
+	})
+}
+
+// Return the heater with the given name or nil if there isn't one
+func (r *Registry) Get(name string) *heaterSetting.HeaterSetting {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, d := range r.diverters {
+		if d.Name == name {
+			return d.Heater
+		}
+	}
+	return nil
+}
+
+// Return the diverters in priority order
+func (r *Registry) GetAll() []*Diverter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*Diverter(nil), r.diverters...)
+}
+
+// Return the original hot water tank heater or the first diverter if it isn't configured
+func (r *Registry) GetPrimary() *heaterSetting.HeaterSetting {
+	if h := r.Get(HotTank); h != nil {
+		return h
+	}
+	all := r.GetAll()
+	if len(all) == 0 {
+		return nil
+	}
+	return all[0].Heater
+}
+
+// Enable or disable every diverter
+func (r *Registry) SetEnabled(enabled bool) {
+	for _, d := range r.GetAll() {
+		d.Heater.SetEnabled(enabled)
+	}
+}
+
+// Turn every diverter off. Diverters being boosted stay at their boost level.
+func (r *Registry) AllOff() {
+	for _, d := range r.GetAll() {
+		d.Heater.SetHeater(0)
+	}
+}
+
+// Disable every diverter and turn its elements and pump off straight away. Used when shutting down.
+func (r *Registry) SwitchOff() {
+	for _, d := range r.GetAll() {
+		d.Heater.SetEnabled(false)
+		d.Heater.SwitchOff()
+	}
+}
+
+// Hold every diverter off, including any being boosted or running a legionella cycle, until released. Used while
+// the generator runs.
+func (r *Registry) SetForcedOff(off bool) {
+	for _, d := range r.GetAll() {
+		d.Heater.SetForcedOff(off)
+	}
+}
+
+// Turn up the first diverter in priority order that can take more. Return false if none of them can.
+func (r *Registry) Increase(frequency float64) bool {
+	for _, d := range r.GetAll() {
+		if d.Heater.CanIncrease() {
+			return d.Heater.Increase(frequency)
+		}
+	}
+	return false
+}
+
+// Turn down the last diverter in priority order that is on. Return false if they are all off or being boosted.
+func (r *Registry) Decrease(ignoreTime bool) bool {
+	all := r.GetAll()
+	for i := len(all) - 1; i >= 0; i-- {
+		if all[i].Heater.CanDecrease() {
+			return all[i].Heater.Decrease(ignoreTime)
+		}
+	}
+	return false
+}
+
+// Total power drawn by all the diverters
+func (r *Registry) GetWatts() int {
+	total := 0
+	for _, d := range r.GetAll() {
+		total += d.Heater.GetWatts()
+	}
+	return total
+}
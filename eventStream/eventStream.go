@@ -0,0 +1,195 @@
+package eventStream
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pushes status changes to clients as they happen so they don't have to poll.
+//
+// Each event has a type such as "inverter" or "cars" and carries the complete new state of that part of the system.
+// A client that falls behind, or asks to be throttled, only gets the latest event of each type so it can never build
+// up a backlog. New clients are sent the latest event of every type straight away.
+
+// The fastest rate a client can ask for
+const MinInterval = 100 * time.Millisecond
+
+// How often a stream sends something to keep proxies from closing it and to find clients that have gone
+const keepAliveInterval = 30 * time.Second
+
+type Event struct {
+	Type string          `json:"type"`
+	Time time.Time       `json:"time"`
+	Data json.RawMessage `json:"data"`
+}
+
+type Hub struct {
+	latest    map[string]Event
+	clients   map[*client]bool
+	closed    chan struct{} // Closed to end every stream
+	closeOnce sync.Once
+	mu        sync.Mutex
+}
+
+type client struct {
+	types    map[string]bool  // nil for every type
+	interval time.Duration    // Least time between sends
+	pending  map[string]Event // Latest unsent event of each type
+	wake     chan struct{}
+	mu       sync.Mutex
+}
+
+func New() *Hub {
+	return &Hub{latest: make(map[string]Event), clients: make(map[*client]bool), closed: make(chan struct{})}
+}
+
+// End every stream. Used when the web server shuts down because it won't wait for them.
+func (h *Hub) Close() {
+	h.closeOnce.Do(func() {
+		close(h.closed)
+	})
+}
+
+// Send an event to every client that wants it
+func (h *Hub) Publish(eventType string, data interface{}) {
+	h.publish(eventType, data, false)
+}
+
+// Send an event only if data is different from the last event of the same type. Use this for state that is polled.
+func (h *Hub) PublishIfChanged(eventType string, data interface{}) {
+	h.publish(eventType, data, true)
+}
+
+func (h *Hub) publish(eventType string, data interface{}, onlyChanges bool) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		glog.Errorf("Failed to encode the %s event - %s", eventType, err)
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if last, found := h.latest[eventType]; onlyChanges && found && bytes.Equal(last.Data, b) {
+		return
+	}
+	e := Event{Type: eventType, Time: time.Now(), Data: b}
+	h.latest[eventType] = e
+	for c := range h.clients {
+		c.offer(e)
+	}
+}
+
+// Add a client and queue the latest event of every type it wants
+func (h *Hub) subscribe(types map[string]bool, interval time.Duration) *client {
+	c := &client{types: types, interval: interval, pending: make(map[string]Event), wake: make(chan struct{}, 1)}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, e := range h.latest {
+		c.offer(e)
+	}
+	h.clients[c] = true
+	return c
+}
+
+func (h *Hub) unsubscribe(c *client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.clients, c)
+}
+
+// Return the number of connected clients
+func (h *Hub) GetClients() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.clients)
+}
+
+// Queue an event, replacing any unsent event of the same type
+func (c *client) offer(e Event) {
+	if (c.types != nil) && !c.types[e.Type] {
+		return
+	}
+	c.mu.Lock()
+	c.pending[e.Type] = e
+	c.mu.Unlock()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Take the queued events oldest first
+func (c *client) take() []Event {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	events := make([]Event, 0, len(c.pending))
+	for _, e := range c.pending {
+		events = append(events, e)
+	}
+	c.pending = make(map[string]Event)
+	sort.Slice(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	return events
+}
+
+// Read the client's choices from the query string.
+//
+//	interval - Least time between updates as a Go duration such as 500ms or 5s. Default and minimum 100ms.
+//	events   - Comma separated list of the event types wanted. Default all of them.
+func parseOptions(r *http.Request) (types map[string]bool, interval time.Duration, err error) {
+	interval = MinInterval
+	if s := r.URL.Query().Get("interval"); s != "" {
+		interval, err = time.ParseDuration(s)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid interval %s - use something like 500ms or 5s", s)
+		}
+		if interval < MinInterval {
+			interval = MinInterval
+		}
+	}
+	if s := r.URL.Query().Get("events"); s != "" {
+		types = make(map[string]bool)
+		for _, t := range strings.Split(s, ",") {
+			types[strings.TrimSpace(t)] = true
+		}
+	}
+	return types, interval, nil
+}
+
+// Wait for events and pass them to send, no more often than the client's interval. keepAlive is called every so often
+// to check the client is still there. Returns when done or closed is closed or either function fails.
+func (c *client) run(done <-chan struct{}, closed <-chan struct{}, keepAlive func() error, send func(Event) error) {
+	keepAliveTicker := time.NewTicker(keepAliveInterval)
+	defer keepAliveTicker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-closed:
+			return
+		case <-keepAliveTicker.C:
+			if err := keepAlive(); err != nil {
+				return
+			}
+			continue
+		case <-c.wake:
+		}
+		for _, e := range c.take() {
+			if err := send(e); err != nil {
+				return
+			}
+		}
+		select {
+		case <-done:
+			return
+		case <-closed:
+			return
+		case <-time.After(c.interval):
+		}
+	}
+}
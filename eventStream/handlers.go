@@ -0,0 +1,99 @@
+package eventStream
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"time"
+)
+
+// How long a WebSocket client has to take a message before we give up on it
+const writeTimeout = 10 * time.Second
+
+// The origin is checked by the access control in front of the router
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+// Stream events as Server-Sent Events. Each event is sent with its type as the SSE event name and the whole event as
+// the data so a browser EventSource can either listen for the types it wants or take every message.
+func (h *Hub) ServeSSE(w http.ResponseWriter, r *http.Request) {
+	types, interval, err := parseOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // Stop nginx holding the events back
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	c := h.subscribe(types, interval)
+	defer h.unsubscribe(c)
+	c.run(r.Context().Done(), h.closed, func() error {
+		_, err := fmt.Fprint(w, ": keep alive\n\n")
+		flusher.Flush()
+		return err
+	}, func(e Event) error {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, b)
+		flusher.Flush()
+		return err
+	})
+}
+
+// Stream events over a WebSocket. Each event is sent as a JSON text message. Anything the client sends is ignored.
+func (h *Hub) ServeWebSocket(w http.ResponseWriter, r *http.Request) {
+	types, interval, err := parseOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already sent the error to the client
+		glog.Errorf("WebSocket upgrade failed - %s", err)
+		return
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	// Control frames are only handled while reading so keep reading until the client goes away
+	done := make(chan struct{})
+	conn.SetReadLimit(1024)
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	c := h.subscribe(types, interval)
+	defer h.unsubscribe(c)
+	c.run(done, h.closed, func() error {
+		return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout))
+	}, func(e Event) error {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		_ = conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		return conn.WriteMessage(websocket.TextMessage, b)
+	})
+}
@@ -2,8 +2,7 @@ package heaterSetting
 
 import (
 	"github.com/golang/glog"
-	"github.com/stianeikeland/go-rpio"
-	"math"
+	"sort"
 	"sync"
 	"time"
 )
@@ -21,10 +20,72 @@ import (
 *  5	2.5kW heater element (med)
 ****************************************************************************************/
 
-const pump = 23 // Pump is on GPIO 4
+// Heater elements and pump as wired on the original tank. Used if the configuration does not describe the heater.
+// Pin numbers are BCM GPIO numbers. The elements switch on with a high output and the pump with a low output.
+// Heater SSR port pins are in order of least powerful to most powerful.
+func DefaultConfig() Config {
+	return Config{
+		Elements: []Element{
+			{Pin: 6, Watts: 2500},
+			{Pin: 24, Watts: 6000},
+			{Pin: 22, Watts: 6000},
+		},
+		PumpPin:          23, // Pump is on GPIO 4
+		PumpRunOnSeconds: int(defaultPumpRunOn / time.Second),
+		MaxTemp:          defaultMaxTemp,
+	}
+}
+
+// One heater element
+type Element struct {
+	Pin       uint8 `json:"pin"`
+	Watts     int   `json:"watts"`
+	ActiveLow bool  `json:"activeLow"` // The element is on when the output is low
+}
+
+// Describes how the heater is wired up
+type Config struct {
+	Elements         []Element          `json:"elements"`
+	PumpPin          uint8              `json:"pumpPin"`
+	PumpActiveHigh   bool               `json:"pumpActiveHigh"`   // The pump runs when the output is high
+	PumpRunOnSeconds int                `json:"pumpRunOnSeconds"` // How long the pump keeps going after the elements go off. 0 uses the default
+	NoPump           bool               `json:"noPump"`           // There is no pump, e.g. a pool heater or space heater relay
+	ConfirmFlow      bool               `json:"confirmFlow"`      // Only energise the elements while the flow switch shows water moving
+	FlowPin          uint8              `json:"flowPin"`          // Input from the flow switch
+	FlowActiveHigh   bool               `json:"flowActiveHigh"`   // The flow switch input is high when there is flow
+	FlowLossSeconds  int                `json:"flowLossSeconds"`  // How long flow can drop out before the elements are turned off. 0 uses the default
+	FlowWaitSeconds  int                `json:"flowWaitSeconds"`  // How long the pump runs waiting for flow before giving up. 0 uses the default
+	MaxTemp          int16              `json:"maxTemp"`          // Hard cut-off. Turn off above this temperature (Deg C x 10). 0 uses the default
+	TargetTemp       int16              `json:"targetTemp"`       // Stop heating from surplus power at this temperature (Deg C x 10). 0 uses MaxTemp
+	Hysteresis       int16              `json:"hysteresis"`       // Drop this far below the target or cut-off before heating again (Deg C x 10). 0 uses the default
+	BoostTemp        int16              `json:"boostTemp"`        // Below this temperature heat to the target even without surplus power (Deg C x 10). 0 = never
+	BoostWatts       int                `json:"boostWatts"`       // Most power to boost with. 0 = every element
+	Legionella       *LegionellaConfig  `json:"legionella"`       // Leave out if the tank needs no legionella cycle
+	NoTempLimit      bool               `json:"noTempLimit"`      // There is no temperature to watch so never turn off for it
+	Temperature      *TemperatureConfig `json:"temperature"`      // Where the tank temperature comes from
+	ElementStateFile string             `json:"elementStateFile"` // Where element run times are kept across restarts
+}
+
+// How long the pump keeps going after the elements go off so the heated water reaches the tank
+const defaultPumpRunOn = 30 * time.Second
+
+// Hot tank temperature above which the elements are turned off (Deg C x 10)
+const defaultMaxTemp = 950
+
+// How far the temperature has to fall below the target or cut-off before the elements can come back on (Deg C x 10)
+const defaultHysteresis = 30
+
+// How long flow can drop out while the elements are on before they are turned off
+const defaultFlowLoss = 5 * time.Second
+
+// How long the pump runs waiting for flow before it is stopped and left to rest for the same time
+const defaultFlowWait = time.Minute
 
-// Array of heater SSR port pins in order of least powerful to most powerful
-var heaters = [...]uint8{6, 24, 22}
+// Longest flow wait allowed so a broken flow switch can't leave the pump running dry
+const maxFlowWait = 10 * time.Minute
+
+// Elements are switched using a bit mask so we can't have more than this
+const maxElements = 8
 
 type HeaterSetting struct {
 	enabled bool        // Only turn on heater elements if enabled == true
@@ -32,37 +93,192 @@ type HeaterSetting struct {
 	mu      sync.Mutex  // Controls access
 	timer   *time.Timer // Used to turn the pump off after a delay to ensure all
 	// the heated water is pumped into the main storage tank
-	currentSetting     uint8     // o = off. Defines which elements are switched on
-	maxSetting         uint8     // Calculated by the constructor based on the number of heater elements defined
+	currentSetting     uint8     // o = off. Index into levels
+	maxSetting         uint8     // Calculated by the constructor based on the heater elements defined
 	dontDecreaseBefore time.Time // This is used to hold off a decrease to give the string inverters a chance to ramp up
 	dontIncreaseBefore time.Time // This is used to prevent an increase if we have just increased within a short time
 	// to stop running up to quickly.
-	hotTankTemp int16 // Hot tank temperature (Deg C x 10) Max allowed = 95C (950)
+	hotTankTemp      int16        // Hot tank temperature (Deg C x 10) Max allowed = 95C (950)
+	gpio             OutputDriver // Drives the heater element and pump pins
+	elements         []Element    // Heater elements. Bit n of a level switches elements[n]
+	levels           []uint8      // Combinations of elements in order of increasing power. levels[0] is off
+	alternatives     [][]uint8    // Every combination of elements giving the power of each level
+	levelWatts       []int        // Power drawn at each level
+	pumpPin          uint8
+	pumpActiveHigh   bool
+	pumpRunOn        time.Duration // How long the pump keeps running after the elements are turned off
+	noPump           bool
+	maxTemp          int16            // Elements are turned off above this temperature (Deg C x 10). 0 = no limit
+	targetTemp       int16            // Surplus heating stops at this temperature (Deg C x 10)
+	hysteresis       int16            // How far below targetTemp or maxTemp we must fall before heating again
+	boostTemp        int16            // Boost to targetTemp when below this temperature. 0 = never boost
+	boostSetting     uint8            // Level used while boosting
+	tooHot           bool             // Above maxTemp and not yet cooled by hysteresis
+	atTarget         bool             // Reached targetTemp and not yet cooled by hysteresis
+	boosting         bool             // Heating to targetTemp regardless of surplus power
+	forcedOff        bool             // Held off whatever boosts or legionella cycles want, e.g. while the generator runs
+	temperatureStale bool             // The last temperature reading failed or was too old
+	legionella       *legionella      // nil if this heater has no legionella cycle
+	elementStats     []elementRuntime // Run time of each element
+	elementStateFile string
+	confirmFlow      bool
+	flowPin          uint8
+	flowActiveHigh   bool
+	flowLoss         time.Duration
+	flowWait         time.Duration
+	lastFlow         time.Time // When the flow switch last showed flow
+	noFlow           bool      // Elements were held off or turned off because there was no flow
+	flowWaitStart    time.Time // When we started waiting for flow
+	flowRetryAt      time.Time // The pump rests until then after a wait for flow timed out
 }
 
-func New() *HeaterSetting {
+func New(gpio OutputDriver, config Config) *HeaterSetting {
 	h := new(HeaterSetting)
+	h.gpio = gpio
+	err := h.gpio.Open()
+	if err != nil {
+		glog.Errorf("Failed to open the GPIO ports. - %s\n", err)
+	}
+	if len(config.Elements) > maxElements {
+		glog.Errorf("Only %d heater elements can be used. Ignoring the rest.\n", maxElements)
+		config.Elements = config.Elements[:maxElements]
+	}
+	h.elements = config.Elements
+	h.alternatives = buildLevels(h.elements)
+	for _, masks := range h.alternatives {
+		h.levels = append(h.levels, masks[0])
+		h.levelWatts = append(h.levelWatts, maskWatts(h.elements, masks[0]))
+	}
+	h.newElementStats(config.ElementStateFile)
+	h.maxSetting = uint8(len(h.levels) - 1)
+	h.pumpPin = config.PumpPin
+	h.pumpActiveHigh = config.PumpActiveHigh
+	h.pumpRunOn = time.Duration(config.PumpRunOnSeconds) * time.Second
+	if h.pumpRunOn <= 0 {
+		if h.pumpRunOn < 0 {
+			glog.Errorf("Pump run on of %s is not allowed. Using %s\n", h.pumpRunOn, defaultPumpRunOn)
+		}
+		h.pumpRunOn = defaultPumpRunOn
+	}
+	h.noPump = config.NoPump
+	h.maxTemp = config.MaxTemp
+	if h.maxTemp == 0 {
+		h.maxTemp = defaultMaxTemp
+	}
+	h.targetTemp = config.TargetTemp
+	if (h.targetTemp == 0) || (h.targetTemp > h.maxTemp) {
+		h.targetTemp = h.maxTemp
+	}
+	h.hysteresis = config.Hysteresis
+	if h.hysteresis == 0 {
+		h.hysteresis = defaultHysteresis
+	}
+	if config.NoTempLimit {
+		h.maxTemp = 0
+		h.targetTemp = 0
+	} else {
+		h.boostTemp = config.BoostTemp
+	}
+	h.boostSetting = h.maxSetting
+	if config.BoostWatts > 0 {
+		h.boostSetting = 0
+		for i, w := range h.levelWatts {
+			if w <= config.BoostWatts {
+				h.boostSetting = uint8(i)
+			}
+		}
+	}
+	h.confirmFlow = config.ConfirmFlow && !config.NoPump
+	h.flowPin = config.FlowPin
+	h.flowActiveHigh = config.FlowActiveHigh
+	h.flowLoss = time.Duration(config.FlowLossSeconds) * time.Second
+	if h.flowLoss == 0 {
+		h.flowLoss = defaultFlowLoss
+	}
+	h.flowWait = time.Duration(config.FlowWaitSeconds) * time.Second
+	if h.flowWait <= 0 {
+		if h.flowWait < 0 {
+			glog.Errorf("Flow wait of %s is not allowed. Using %s\n", h.flowWait, defaultFlowWait)
+		}
+		h.flowWait = defaultFlowWait
+	} else if h.flowWait > maxFlowWait {
+		glog.Errorf("Flow wait of %s is too long. Using %s\n", h.flowWait, maxFlowWait)
+		h.flowWait = maxFlowWait
+	}
+	if (config.Legionella != nil) && (h.maxTemp > 0) {
+		h.legionella = newLegionella(*config.Legionella)
+	}
 	h.enabled = true
 	h.hotTankTemp = 1000
+	h.tooHot = h.maxTemp > 0
+	h.atTarget = h.targetTemp > 0
 	h.SetHeater(0) // Ensures all ports are configured correctly
-	h.maxSetting = uint8(math.Pow(2, float64(len(heaters)))) - 1
 	h.dontDecreaseBefore = time.Now()
 	h.dontIncreaseBefore = time.Now()
+	if h.confirmFlow {
+		go h.watchFlow()
+	}
 	return h
 }
 
+// Work out every combination of elements and put them in order of power. Combinations that give the same power are
+// grouped into one level so each step up or down really changes the power. The elements used for a level can then be
+// rotated between the combinations in its group.
+func buildLevels(elements []Element) [][]uint8 {
+	var combinations []uint8
+	for mask := 0; mask < (1 << uint(len(elements))); mask++ {
+		combinations = append(combinations, uint8(mask))
+	}
+	sort.SliceStable(combinations, func(i, j int) bool {
+		return maskWatts(elements, combinations[i]) < maskWatts(elements, combinations[j])
+	})
+	levels := [][]uint8{{0}}
+	for _, mask := range combinations[1:] {
+		last := len(levels) - 1
+		if maskWatts(elements, mask) > maskWatts(elements, levels[last][0]) {
+			levels = append(levels, []uint8{mask})
+		} else {
+			levels[last] = append(levels[last], mask)
+		}
+	}
+	return levels
+}
+
+// Total power of the elements switched on by mask
+func maskWatts(elements []Element, mask uint8) int {
+	total := 0
+	for i, e := range elements {
+		if (mask>>uint(i))&1 > 0 {
+			total += e.Watts
+		}
+	}
+	return total
+}
+
 // Set the heater power.
 func (h *HeaterSetting) SetHeater(setting uint8) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
+	h.setLevel(setting)
+}
 
+// Set the heater power. Must be called with the lock held.
+func (h *HeaterSetting) setLevel(setting uint8) {
 	// On/Off control
-	if !h.enabled {
+	if !h.enabled || h.forcedOff {
 		setting = 0
 	}
 
 	// Overheating prevention
-	if h.hotTankTemp > 950 {
+	if h.isTooHot() {
+		setting = 0
+	} else if h.heldOn() && (setting < h.boostSetting) {
+		// Boosting or a legionella cycle holds the heater up even when there is no surplus
+		setting = h.boostSetting
+	}
+
+	// Let the pump rest after it failed to get the water moving
+	if h.confirmFlow && time.Now().Before(h.flowRetryAt) {
 		setting = 0
 	}
 
@@ -70,7 +286,7 @@ func (h *HeaterSetting) SetHeater(setting uint8) {
 		// Schedule the pump to stop if it is not already scheduled
 		h.pump = false
 		if h.timer == nil {
-			h.timer = time.AfterFunc(time.Second*30, h.turnOffPump)
+			h.timer = time.AfterFunc(h.pumpRunOn, h.turnOffPump)
 		}
 	} else {
 		// Start the pump first
@@ -80,12 +296,26 @@ func (h *HeaterSetting) SetHeater(setting uint8) {
 		}
 		h.pump = true
 		h.turnOnPump()
+		if h.confirmFlow && !h.hasFlow() {
+			// Keep the elements off until the water is moving. The pump is stopped if the flow wait runs out however
+			// often we are asked.
+			if !h.noFlow {
+				glog.Infof("Waiting for flow before turning on the heater elements")
+				h.noFlow = true
+				h.flowWaitStart = time.Now()
+			}
+			setting = 0
+			h.timer = time.AfterFunc(time.Until(h.flowWaitStart.Add(h.flowWait)), h.flowTimedOut)
+		}
 	}
-	// Set the heating elements up
-	h.currentSetting = setting
-	if h.currentSetting > h.maxSetting {
-		h.currentSetting = h.maxSetting
+	// Set the heating elements up. Use the least worn elements that give the new power.
+	if setting > h.maxSetting {
+		setting = h.maxSetting
 	}
+	if setting != h.currentSetting {
+		h.levels[setting] = h.leastUsed(setting)
+	}
+	h.currentSetting = setting
 
 	// Actually turn on or off the heating elements
 	h.setHeater()
@@ -98,12 +328,91 @@ func (h *HeaterSetting) turnOffPump() {
 	h.timer = nil
 	h.pump = false
 	h.currentSetting = 0
+	h.noFlow = false
 	// Actually turn the elements off if they are not already...
 	h.setHeater()
 	// Now turn the pump off
-	p := rpio.Pin(pump)
-	p.Mode(rpio.Output)
-	p.High()
+	if h.noPump {
+		return
+	}
+	err := h.gpio.SetOutput(h.pumpPin, !h.pumpActiveHigh)
+	if err != nil {
+		glog.Errorf("Failed to turn the pump off. - %s\n", err)
+	}
+}
+
+// Turn the elements and the pump off straight away without waiting for the pump run on. Used when shutting down.
+func (h *HeaterSetting) SwitchOff() {
+	h.mu.Lock()
+	if h.timer != nil {
+		h.timer.Stop()
+	}
+	h.mu.Unlock()
+	h.turnOffPump()
+}
+
+// Read the flow switch. Must be called with the lock held.
+func (h *HeaterSetting) hasFlow() bool {
+	high, err := h.gpio.ReadInput(h.flowPin)
+	if err != nil {
+		glog.Errorf("Failed to read the flow switch. - %s\n", err)
+		return false
+	}
+	if high == h.flowActiveHigh {
+		h.lastFlow = time.Now()
+		if h.noFlow {
+			glog.Infof("Flow confirmed")
+			h.noFlow = false
+		}
+		return true
+	}
+	return false
+}
+
+// Turn the elements off if the flow stops while they are on
+func (h *HeaterSetting) watchFlow() {
+	for {
+		time.Sleep(time.Second)
+		h.mu.Lock()
+		if !h.hasFlow() && (h.currentSetting > 0) && (time.Since(h.lastFlow) > h.flowLoss) {
+			glog.Errorf("No flow for %s. Turning the heater elements off", h.flowLoss)
+			glog.Flush()
+			h.noFlow = true
+			h.flowWaitStart = time.Now()
+			h.currentSetting = 0
+			h.setHeater()
+			// The pump keeps going in case the flow comes back and stops if it hasn't by the end of the flow wait
+			if h.timer != nil {
+				h.timer.Stop()
+			}
+			h.timer = time.AfterFunc(h.flowWait, h.flowTimedOut)
+		}
+		h.mu.Unlock()
+	}
+}
+
+// Stop the pump at the end of the flow wait. If there is still no flow it rests for the flow wait before it is tried
+// again so it doesn't run dry.
+func (h *HeaterSetting) flowTimedOut() {
+	h.mu.Lock()
+	if h.noFlow {
+		glog.Errorf("No flow after %s. Stopping the pump for %s", h.flowWait, h.flowWait)
+		glog.Flush()
+		h.flowRetryAt = time.Now().Add(h.flowWait)
+	}
+	h.mu.Unlock()
+	h.turnOffPump()
+}
+
+// Flow switch state. flow is false if the heater has no flow switch. waiting is true if the elements are being
+// held off because there is no flow.
+func (h *HeaterSetting) GetFlow() (flow bool, waiting bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.confirmFlow {
+		return false, false
+	}
+	return h.hasFlow(), h.noFlow
 }
 
 func (h *HeaterSetting) turnOnPump() {
@@ -111,28 +420,87 @@ func (h *HeaterSetting) turnOnPump() {
 	if h.timer != nil {
 		h.timer.Stop()
 	}
-	err := rpio.Open()
+	if h.noPump {
+		return
+	}
+	err := h.gpio.SetOutput(h.pumpPin, h.pumpActiveHigh)
 	if err != nil {
-		glog.Errorf("Failed to open the GPIO ports. - %s\n", err)
+		glog.Errorf("Failed to turn the pump on. - %s\n", err)
 		return
 	}
-	p := rpio.Pin(pump)
-	p.Mode(rpio.Output)
-	p.Low()
-	if p.Read() != 0 {
+	high, err := h.gpio.ReadPin(h.pumpPin)
+	if err != nil || high != h.pumpActiveHigh {
 		glog.Errorln("Failed to turn the pump on!")
 	}
 
 }
 
+// Set the heater to the most power it can draw without going over watts. Returns the power actually set.
+func (h *HeaterSetting) SetPower(watts int) int {
+	setting := 0
+	for i, w := range h.levelWatts {
+		if w <= watts {
+			setting = i
+		}
+	}
+	h.SetHeater(uint8(setting))
+	return h.GetWatts()
+}
+
+// Move up to the next combination of elements that draws more power. Return false if we are already at maximum.
+func (h *HeaterSetting) StepUp() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.stepUp()
+}
+
+// Must be called with the lock held
+func (h *HeaterSetting) stepUp() bool {
+	if h.currentSetting >= h.maxSetting {
+		return false
+	}
+	h.setLevel(h.currentSetting + 1)
+	return true
+}
+
+// Move down to the next combination of elements that draws less power. Return false if we are already off or held
+// on by a boost.
+func (h *HeaterSetting) StepDown() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.stepDown()
+}
+
+// Must be called with the lock held
+func (h *HeaterSetting) stepDown() bool {
+	if !h.canDecrease() {
+		return false
+	}
+	h.setLevel(h.currentSetting - 1)
+	return true
+}
+
+// Power drawn by the elements that are on
+func (h *HeaterSetting) GetWatts() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.levelWatts[h.currentSetting]
+}
+
+// Power drawn with every element on
+func (h *HeaterSetting) GetMaxWatts() int {
+	return h.levelWatts[h.maxSetting]
+}
+
 // Increase the heater current. Return true if we did increase it or false if we are already at maximum.
 func (h *HeaterSetting) Increase(frequency float64) bool {
-	var setting = h.currentSetting
-	if setting < h.maxSetting {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.currentSetting < h.maxSetting {
 		if h.dontIncreaseBefore.After(time.Now()) {
 			return true
 		}
-		h.SetHeater(setting + 1)
+		h.stepUp()
 		if frequency > 60.0 {
 			// Based on how high above 60Hz the frequency is we should hold this new level to let the string inverters
 			// ramp up. Hold for 15 seconds for each Hz over 60.
@@ -147,19 +515,19 @@ func (h *HeaterSetting) Increase(frequency float64) bool {
 	}
 }
 
-// Drop the heater current. Return true if we dropped it or false if we are already fully off
+// Drop the heater current. Return true if we dropped it or false if we are already fully off or held on by a boost.
 // ignoreTime tells us not to wait for the string inverters. This is used if we are dropping the
 // heater because we are ramping up the car.
 func (h *HeaterSetting) Decrease(ignoreTime bool) bool {
-	var setting = h.currentSetting
-	if setting > 0 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.canDecrease() {
 		if !ignoreTime && h.dontDecreaseBefore.After(time.Now()) {
 			// We are still holding the heater in case the string inverters are able to ramp up so pretend we
 			// decreased but don't actually change anything
 			return true
 		} else {
-			h.SetHeater(setting - 1)
-			return true
+			return h.stepDown()
 		}
 	} else {
 		return false
@@ -168,28 +536,35 @@ func (h *HeaterSetting) Decrease(ignoreTime bool) bool {
 
 // Internal function to drive the port pins controlling the Solid state Relays
 func (h *HeaterSetting) setHeater() {
-	err := rpio.Open()
-	if err != nil {
-		glog.Errorf("Failed to open the GPIO ports. - %s\n", err)
-		return
-	}
-	for i, p := range heaters {
-		val := ((h.currentSetting >> uint(i)) & 1) > 0
-		pin := rpio.Pin(p)
-		pin.Mode(rpio.Output)
-		if val {
-			pin.High()
-		} else {
-			pin.Low()
+	mask := h.levels[h.currentSetting]
+	h.recordElements(mask)
+	for i, e := range h.elements {
+		val := ((mask >> uint(i)) & 1) > 0
+		err := h.gpio.SetOutput(e.Pin, val != e.ActiveLow)
+		if err != nil {
+			glog.Errorf("Failed to set heater element on pin %d. - %s\n", e.Pin, err)
 		}
 	}
 }
 
+// Return the power level. 0 is off and each level up draws more power than the one before.
 func (h *HeaterSetting) GetSetting() uint8 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	return h.currentSetting
 }
 
+// Return the elements that are on as a bit mask with bit n for element n. This is what the setting was before the
+// levels were put in order of power and is still what the database logs.
+func (h *HeaterSetting) GetElementMask() uint8 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.levels[h.currentSetting]
+}
+
 func (h *HeaterSetting) GetEnabled() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	if h.enabled {
 		return "ON"
 	} else {
@@ -197,25 +572,146 @@ func (h *HeaterSetting) GetEnabled() string {
 	}
 }
 
+// Hold the heater off, even if it is boosting or running a legionella cycle, until it is released. This is for when
+// the power must not be used at all, such as while the generator runs. Boosts and legionella cycles pick up again
+// once released.
+func (h *HeaterSetting) SetForcedOff(off bool) {
+	h.mu.Lock()
+	h.forcedOff = off
+	boost := h.heldOn() && (h.currentSetting < h.boostSetting)
+	h.mu.Unlock()
+	if off {
+		h.SetHeater(0)
+	} else if boost {
+		h.SetHeater(h.boostSetting)
+	}
+}
+
+func (h *HeaterSetting) GetForcedOff() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.forcedOff
+}
+
 func (h *HeaterSetting) SetEnabled(bSetting bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	h.enabled = bSetting
 	if !bSetting {
-		h.SetHeater(0)
+		h.setLevel(0)
 	}
 }
 
 func (h *HeaterSetting) GetHotTankTemp() int16 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	return h.hotTankTemp
 }
 
+// Record the tank temperature and run the thermostat. The elements go off above the cut-off or once the target is
+// reached and stay off until the temperature drops by the hysteresis. Below the boost temperature the heater is
+// turned on until the target is reached whether or not there is surplus power. While a legionella cycle is due the
+// target is raised to the legionella temperature.
 func (h *HeaterSetting) SetHotTankTemp(t int16) {
+	h.mu.Lock()
 	h.hotTankTemp = t
-	if t > 950 {
+	target := h.targetTemp
+	var cycleCompleted time.Time
+	if h.legionella != nil {
+		l, completed := h.legionella.update(t, !h.temperatureStale, time.Now())
+		if completed {
+			cycleCompleted = h.legionella.lastCycle
+		}
+		if l > target {
+			target = l
+			if target > h.maxTemp {
+				target = h.maxTemp
+			}
+		}
+	}
+	if h.maxTemp > 0 {
+		if t > h.maxTemp {
+			h.tooHot = true
+		} else if t <= h.maxTemp-h.hysteresis {
+			h.tooHot = false
+		}
+	}
+	if target > 0 {
+		if t >= target {
+			h.atTarget = true
+		} else if t <= target-h.hysteresis {
+			h.atTarget = false
+		}
+	}
+	if (h.boostTemp > 0) && (t < h.boostTemp) && (t < h.maxTemp) {
+		if !h.boosting && h.enabled {
+			glog.Infof("Tank temperature %0.1fC is below %0.1fC. Boosting to %0.1fC", float32(t)/10, float32(h.boostTemp)/10, float32(target)/10)
+		}
+		h.boosting = true
+		h.atTarget = false
+	} else if h.atTarget || h.tooHot {
+		h.boosting = false
+	}
+	tooHot := h.isTooHot()
+	boost := h.heldOn() && (h.currentSetting < h.boostSetting)
+	h.mu.Unlock()
+	if !cycleCompleted.IsZero() {
+		h.legionella.save(cycleCompleted)
+	}
+	if tooHot {
 		h.SetHeater(0)
+	} else if boost {
+		h.SetHeater(h.boostSetting)
 	}
 }
 
+func (h *HeaterSetting) isTooHot() bool {
+	return h.tooHot || h.atTarget
+}
+
+// True if a boost or legionella cycle should keep the heater on at its boost level
+func (h *HeaterSetting) heldOn() bool {
+	return h.enabled && !h.forcedOff && (h.boosting || ((h.legionella != nil) && h.legionella.forcing))
+}
+
+// True if the heater is enabled, not forced off, not too hot and has another step to go up
+func (h *HeaterSetting) CanIncrease() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.enabled && !h.forcedOff && !h.isTooHot() && (h.currentSetting < h.maxSetting)
+}
+
+// True if the heater is on and not being held on by a boost or legionella cycle
+func (h *HeaterSetting) CanDecrease() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.canDecrease()
+}
+
+// Must be called with the lock held
+func (h *HeaterSetting) canDecrease() bool {
+	if h.heldOn() {
+		return h.currentSetting > h.boostSetting
+	}
+	return h.currentSetting > 0
+}
+
+// True while the heater is heating to its target regardless of surplus power
+func (h *HeaterSetting) GetBoosting() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.boosting && h.enabled
+}
+
+// Target temperature, cut-off and boost temperature (Deg C x 10)
+func (h *HeaterSetting) GetTemperatureLimits() (target int16, cutOff int16, boost int16) {
+	return h.targetTemp, h.maxTemp, h.boostTemp
+}
+
 func (h *HeaterSetting) GetPump() bool {
-	pin := rpio.Pin(pump)
-	return pin.Read() == 0
+	if h.noPump {
+		return false
+	}
+	high, err := h.gpio.ReadPin(h.pumpPin)
+	return (err == nil) && (high == h.pumpActiveHigh)
 }
@@ -0,0 +1,325 @@
+package heaterSetting
+
+import (
+	"testing"
+	"time"
+)
+
+const testPump = 23
+
+func testConfig() Config {
+	return Config{
+		Elements: []Element{
+			{Pin: 6, Watts: 2500},
+			{Pin: 24, Watts: 6000, ActiveLow: true},
+			{Pin: 22, Watts: 6000},
+		},
+		PumpPin:    testPump,
+		MaxTemp:    950,
+		TargetTemp: 650,
+		Hysteresis: 30,
+	}
+}
+
+// Make a heater on the fake driver with the tank cold enough to heat
+func newTestHeater(t *testing.T, config Config) (*HeaterSetting, *FakeDriver) {
+	t.Helper()
+	d := NewFakeDriver()
+	h := New(d, config)
+	h.SetHotTankTemp(400)
+	return h, d
+}
+
+// Add up the power of the elements the driver has switched on
+func wattsOn(t *testing.T, d *FakeDriver, config Config) int {
+	t.Helper()
+	watts := 0
+	for _, e := range config.Elements {
+		high, err := d.ReadPin(e.Pin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if high != e.ActiveLow {
+			watts += e.Watts
+		}
+	}
+	return watts
+}
+
+// The pump is active low unless the configuration says otherwise
+func pumpOn(d *FakeDriver) bool {
+	high, _ := d.ReadPin(testPump)
+	return !high
+}
+
+func TestSetHeater(t *testing.T) {
+	tests := []struct {
+		setting uint8
+		watts   int
+		pump    bool
+	}{
+		{0, 0, false},
+		{1, 2500, true},
+		{2, 6000, true},
+		{3, 8500, true},
+		{4, 12000, true},
+		{5, 14500, true},
+		{9, 14500, true},
+	}
+	config := testConfig()
+	for _, test := range tests {
+		h, d := newTestHeater(t, config)
+		h.SetHeater(test.setting)
+		if got := h.GetWatts(); got != test.watts {
+			t.Errorf("setting %d gives %dW, want %dW", test.setting, got, test.watts)
+		}
+		if got := wattsOn(t, d, config); got != test.watts {
+			t.Errorf("setting %d switched on %dW of elements, want %dW", test.setting, got, test.watts)
+		}
+		if got := maskWatts(config.Elements, h.GetElementMask()); got != test.watts {
+			t.Errorf("setting %d has an element mask of %dW, want %dW", test.setting, got, test.watts)
+		}
+		if test.pump && !pumpOn(d) {
+			t.Errorf("setting %d left the pump off", test.setting)
+		}
+	}
+}
+
+func TestSetPower(t *testing.T) {
+	tests := []struct {
+		watts int
+		want  int
+	}{
+		{0, 0},
+		{2499, 0},
+		{2500, 2500},
+		{7000, 6000},
+		{13000, 12000},
+		{20000, 14500},
+	}
+	config := testConfig()
+	h, d := newTestHeater(t, config)
+	for _, test := range tests {
+		if got := h.SetPower(test.watts); got != test.want {
+			t.Errorf("SetPower(%d) set %dW, want %dW", test.watts, got, test.want)
+		}
+		if got := wattsOn(t, d, config); got != test.want {
+			t.Errorf("SetPower(%d) switched on %dW of elements, want %dW", test.watts, got, test.want)
+		}
+	}
+}
+
+func TestSetHeaterWhenDisabled(t *testing.T) {
+	config := testConfig()
+	h, d := newTestHeater(t, config)
+	h.SetHeater(3)
+	h.SetEnabled(false)
+	if got := wattsOn(t, d, config); got != 0 {
+		t.Errorf("disabling left %dW on", got)
+	}
+	h.SetHeater(3)
+	if got := h.GetWatts(); got != 0 {
+		t.Errorf("a disabled heater turned on %dW", got)
+	}
+}
+
+// The elements go off straight away and the pump keeps going for its run on time
+func TestPumpRunOn(t *testing.T) {
+	config := testConfig()
+	h, d := newTestHeater(t, config)
+	h.mu.Lock()
+	h.pumpRunOn = 100 * time.Millisecond
+	h.mu.Unlock()
+
+	h.SetHeater(2)
+	h.SetHeater(0)
+	stopped := time.Now()
+	if got := wattsOn(t, d, config); got != 0 {
+		t.Fatalf("%dW still on after the heater was turned off", got)
+	}
+	if !pumpOn(d) {
+		t.Fatal("the pump stopped with the elements")
+	}
+	time.Sleep(300 * time.Millisecond)
+	if pumpOn(d) {
+		t.Fatal("the pump was still running after its run on time")
+	}
+	var pumpOff time.Time
+	for _, c := range d.GetHistory() {
+		if (c.Pin == testPump) && c.High {
+			pumpOff = c.Time
+		}
+	}
+	if runOn := pumpOff.Sub(stopped); runOn < 100*time.Millisecond {
+		t.Errorf("the pump ran on for %s, want at least 100ms", runOn)
+	}
+
+	// Turning the heater back on during the run on keeps the pump going
+	h.SetHeater(1)
+	h.SetHeater(0)
+	h.SetHeater(1)
+	time.Sleep(200 * time.Millisecond)
+	if !pumpOn(d) {
+		t.Error("the pump stopped while the heater was on")
+	}
+}
+
+func TestOverheatCutOff(t *testing.T) {
+	config := testConfig()
+	config.TargetTemp = 0 // Heat all the way to the cut-off
+	h, d := newTestHeater(t, config)
+
+	h.SetHeater(5)
+	h.SetHotTankTemp(960)
+	if got := wattsOn(t, d, config); got != 0 {
+		t.Fatalf("%dW still on above the cut-off", got)
+	}
+	if h.CanIncrease() {
+		t.Error("the heater can increase above the cut-off")
+	}
+	tests := []struct {
+		temp int16
+		want int
+	}{
+		{960, 0},
+		{940, 0}, // Within the hysteresis
+		{920, 14500},
+		{949, 14500},
+		{951, 0},
+	}
+	for _, test := range tests {
+		h.SetHotTankTemp(test.temp)
+		h.SetHeater(5)
+		if got := wattsOn(t, d, config); got != test.want {
+			t.Errorf("at %0.1fC %dW is on, want %dW", float32(test.temp)/10, got, test.want)
+		}
+	}
+}
+
+func TestBoostAndForcedOff(t *testing.T) {
+	config := testConfig()
+	config.BoostTemp = 450
+	config.BoostWatts = 6000
+	h, d := newTestHeater(t, config)
+
+	h.SetHeater(0)
+	h.SetHotTankTemp(300)
+	if got := wattsOn(t, d, config); got != 6000 {
+		t.Fatalf("boosting with %dW, want 6000W", got)
+	}
+	h.SetHeater(0)
+	if got := wattsOn(t, d, config); got != 6000 {
+		t.Errorf("turning the heater off dropped the boost to %dW", got)
+	}
+
+	h.SetForcedOff(true)
+	if got := wattsOn(t, d, config); got != 0 {
+		t.Errorf("%dW still on when forced off", got)
+	}
+	h.SetHotTankTemp(300)
+	h.SetHeater(3)
+	if h.CanIncrease() || (wattsOn(t, d, config) != 0) {
+		t.Error("the heater came back on while forced off")
+	}
+
+	h.SetForcedOff(false)
+	if got := wattsOn(t, d, config); got != 6000 {
+		t.Errorf("boost is %dW after release, want 6000W", got)
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	tests := []struct {
+		runOnSeconds int
+		waitSeconds  int
+		runOn        time.Duration
+		wait         time.Duration
+	}{
+		{0, 0, defaultPumpRunOn, defaultFlowWait},
+		{-5, -5, defaultPumpRunOn, defaultFlowWait},
+		{10, 20, 10 * time.Second, 20 * time.Second},
+		{10, 3600, 10 * time.Second, maxFlowWait},
+	}
+	for _, test := range tests {
+		config := testConfig()
+		config.PumpRunOnSeconds = test.runOnSeconds
+		config.FlowWaitSeconds = test.waitSeconds
+		h := New(NewFakeDriver(), config)
+		if (h.pumpRunOn != test.runOn) || (h.flowWait != test.wait) {
+			t.Errorf("run on %ds and flow wait %ds gave %s and %s, want %s and %s", test.runOnSeconds,
+				test.waitSeconds, h.pumpRunOn, h.flowWait, test.runOn, test.wait)
+		}
+	}
+}
+
+// Without flow the elements stay off and the pump gives up after the flow wait, however often it is asked
+func TestFlowWait(t *testing.T) {
+	config := testConfig()
+	config.ConfirmFlow = true
+	config.FlowPin = 27
+	config.FlowActiveHigh = true
+	h, d := newTestHeater(t, config)
+	h.mu.Lock()
+	h.flowWait = 100 * time.Millisecond
+	h.mu.Unlock()
+
+	for i := 0; i < 3; i++ {
+		h.SetHeater(2)
+		time.Sleep(25 * time.Millisecond)
+	}
+	if got := wattsOn(t, d, config); got != 0 {
+		t.Fatalf("%dW on without flow", got)
+	}
+	if _, waiting := h.GetFlow(); !waiting || !pumpOn(d) {
+		t.Fatal("not running the pump and waiting for flow")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if pumpOn(d) {
+		t.Fatal("the pump was still running after the flow wait")
+	}
+	// The pump rests before it is tried again
+	h.SetHeater(2)
+	if pumpOn(d) {
+		t.Error("the pump restarted straight after the flow wait")
+	}
+
+	d.SetInput(27, true)
+	time.Sleep(150 * time.Millisecond)
+	h.SetHeater(2)
+	if got := wattsOn(t, d, config); !pumpOn(d) || (got != 6000) {
+		t.Errorf("with flow the pump is on %v with %dW, want on with 6000W", pumpOn(d), got)
+	}
+}
+
+// Switching off doesn't wait for the pump run on
+func TestSwitchOff(t *testing.T) {
+	config := testConfig()
+	h, d := newTestHeater(t, config)
+	h.SetHeater(3)
+	h.SwitchOff()
+	if got := wattsOn(t, d, config); (got != 0) || pumpOn(d) {
+		t.Errorf("%dW and the pump on %v after switching off, want everything off", got, pumpOn(d))
+	}
+}
+
+// The control loop, API handlers and metrics use the heater at the same time. Run with -race.
+func TestConcurrentAccess(t *testing.T) {
+	h, _ := newTestHeater(t, testConfig())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			h.Increase(50)
+			h.StepUp()
+			h.Decrease(true)
+			h.StepDown()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		h.SetEnabled(i%10 != 0)
+		_ = h.GetEnabled()
+		_ = h.GetWatts()
+		_ = h.CanDecrease()
+	}
+	<-done
+}
@@ -0,0 +1,97 @@
+package heaterSetting
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Drives the GPIO pins for the heater elements, pumps and fan. Pins are numbered the way the driver numbers them,
+// BCM numbers for rpio and line offsets for gpiochip.
+type OutputDriver interface {
+	Open() error
+	SetOutput(pin uint8, high bool) error
+	ReadPin(pin uint8) (high bool, err error)            // Read back an output
+	ReadInput(pin uint8) (high bool, err error)          // Make the pin an input and read it
+	SetPWM(pin uint8, frequency int, duty float32) error // duty is 0 to 1
+	Close() error
+}
+
+// Returned by drivers that can't generate PWM. Callers fall back to switching the pin on and off.
+var ErrPWMNotSupported = errors.New("PWM is not supported by this GPIO driver")
+
+// One change recorded by the fake driver
+type PinChange struct {
+	Pin  uint8
+	High bool
+	Time time.Time
+}
+
+// In memory driver for running off a Raspberry Pi. Records every change so the history can be checked.
+type FakeDriver struct {
+	pins    map[uint8]bool
+	inputs  map[uint8]bool
+	pwm     map[uint8]float32
+	history []PinChange
+	mu      sync.Mutex
+}
+
+func NewFakeDriver() *FakeDriver {
+	return &FakeDriver{pins: make(map[uint8]bool), inputs: make(map[uint8]bool), pwm: make(map[uint8]float32)}
+}
+
+func (d *FakeDriver) Open() error {
+	return nil
+}
+
+func (d *FakeDriver) SetOutput(pin uint8, high bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pins[pin] = high
+	d.history = append(d.history, PinChange{pin, high, time.Now()})
+	return nil
+}
+
+func (d *FakeDriver) ReadPin(pin uint8) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.pins[pin], nil
+}
+
+func (d *FakeDriver) ReadInput(pin uint8) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.inputs[pin], nil
+}
+
+// Set the level the fake driver reads on an input pin
+func (d *FakeDriver) SetInput(pin uint8, high bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.inputs[pin] = high
+}
+
+func (d *FakeDriver) SetPWM(pin uint8, _ int, duty float32) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pwm[pin] = duty
+	return nil
+}
+
+// Return the last duty cycle set on a pin
+func (d *FakeDriver) GetPWM(pin uint8) float32 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.pwm[pin]
+}
+
+func (d *FakeDriver) Close() error {
+	return nil
+}
+
+// Return a copy of every change made so far
+func (d *FakeDriver) GetHistory() []PinChange {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]PinChange(nil), d.history...)
+}
@@ -0,0 +1,156 @@
+//go:build linux
+
+package heaterSetting
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// Linux GPIO character device interface (v1)
+const (
+	gpioHandleRequestInput       = 1 << 0
+	gpioHandleRequestOutput      = 1 << 1
+	gpioGetLineHandleIoctl       = 0xc16cb403 // _IOWR(0xB4, 0x03, struct gpiohandle_request)
+	gpioHandleGetLineValuesIoctl = 0xc040b408 // _IOWR(0xB4, 0x08, struct gpiohandle_data)
+	gpioHandleSetLineValuesIoctl = 0xc040b409 // _IOWR(0xB4, 0x09, struct gpiohandle_data)
+	gpioHandlesMax               = 64
+)
+
+type gpioHandleRequest struct {
+	lineOffsets   [gpioHandlesMax]uint32
+	flags         uint32
+	defaultValues [gpioHandlesMax]uint8
+	consumerLabel [32]byte
+	lines         uint32
+	fd            int32
+}
+
+type gpioHandleData struct {
+	values [gpioHandlesMax]uint8
+}
+
+// Drives the pins through a /dev/gpiochipN character device. Works on any Linux board with a GPIO chip.
+// Each pin is requested as an output the first time it is set or as an input the first time it is read as one.
+// The character device has no PWM.
+type ChipDriver struct {
+	path  string
+	chip  *os.File
+	lines map[uint8]uintptr // Line handle file descriptors by pin
+	mu    sync.Mutex
+}
+
+func NewChipDriver(path string) *ChipDriver {
+	return &ChipDriver{path: path, lines: make(map[uint8]uintptr)}
+}
+
+func (d *ChipDriver) Open() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.chip != nil {
+		return nil
+	}
+	f, err := os.OpenFile(d.path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	d.chip = f
+	return nil
+}
+
+func ioctl(fd uintptr, request uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Return the line handle for the pin, requesting it with the given flags if we don't have it yet.
+// high is the starting level for outputs.
+func (d *ChipDriver) line(pin uint8, flags uint32, high bool) (uintptr, error) {
+	if fd, found := d.lines[pin]; found {
+		return fd, nil
+	}
+	if d.chip == nil {
+		return 0, fmt.Errorf("%s is not open", d.path)
+	}
+	var req gpioHandleRequest
+	req.lineOffsets[0] = uint32(pin)
+	req.flags = flags
+	if high {
+		req.defaultValues[0] = 1
+	}
+	copy(req.consumerLabel[:], "TeslaChargeControl")
+	req.lines = 1
+	if err := ioctl(d.chip.Fd(), gpioGetLineHandleIoctl, unsafe.Pointer(&req)); err != nil {
+		return 0, fmt.Errorf("failed to get line %d from %s - %s", pin, d.path, err)
+	}
+	d.lines[pin] = uintptr(req.fd)
+	return uintptr(req.fd), nil
+}
+
+func (d *ChipDriver) SetOutput(pin uint8, high bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fd, err := d.line(pin, gpioHandleRequestOutput, high)
+	if err != nil {
+		return err
+	}
+	var data gpioHandleData
+	if high {
+		data.values[0] = 1
+	}
+	return ioctl(fd, gpioHandleSetLineValuesIoctl, unsafe.Pointer(&data))
+}
+
+// Read back the level of an output. Pins we have not set read as low.
+func (d *ChipDriver) ReadPin(pin uint8) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fd, found := d.lines[pin]
+	if !found {
+		return false, nil
+	}
+	var data gpioHandleData
+	if err := ioctl(fd, gpioHandleGetLineValuesIoctl, unsafe.Pointer(&data)); err != nil {
+		return false, err
+	}
+	return data.values[0] != 0, nil
+}
+
+func (d *ChipDriver) ReadInput(pin uint8) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fd, err := d.line(pin, gpioHandleRequestInput, false)
+	if err != nil {
+		return false, err
+	}
+	var data gpioHandleData
+	if err := ioctl(fd, gpioHandleGetLineValuesIoctl, unsafe.Pointer(&data)); err != nil {
+		return false, err
+	}
+	return data.values[0] != 0, nil
+}
+
+func (d *ChipDriver) SetPWM(_ uint8, _ int, _ float32) error {
+	return ErrPWMNotSupported
+}
+
+func (d *ChipDriver) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for pin, fd := range d.lines {
+		_ = syscall.Close(int(fd))
+		delete(d.lines, pin)
+	}
+	if d.chip == nil {
+		return nil
+	}
+	err := d.chip.Close()
+	d.chip = nil
+	return err
+}
@@ -0,0 +1,38 @@
+//go:build !linux
+
+package heaterSetting
+
+import (
+	"errors"
+)
+
+// GPIO character devices only exist on Linux
+type ChipDriver struct{}
+
+func NewChipDriver(_ string) *ChipDriver {
+	return new(ChipDriver)
+}
+
+func (d *ChipDriver) Open() error {
+	return errors.New("GPIO character devices need Linux")
+}
+
+func (d *ChipDriver) SetOutput(_ uint8, _ bool) error {
+	return errors.New("GPIO character devices need Linux")
+}
+
+func (d *ChipDriver) ReadPin(_ uint8) (bool, error) {
+	return false, errors.New("GPIO character devices need Linux")
+}
+
+func (d *ChipDriver) ReadInput(_ uint8) (bool, error) {
+	return false, errors.New("GPIO character devices need Linux")
+}
+
+func (d *ChipDriver) SetPWM(_ uint8, _ int, _ float32) error {
+	return ErrPWMNotSupported
+}
+
+func (d *ChipDriver) Close() error {
+	return nil
+}
@@ -0,0 +1,58 @@
+package heaterSetting
+
+import (
+	"github.com/stianeikeland/go-rpio"
+)
+
+// Drives the pins through /dev/gpiomem using go-rpio. Only works on a Raspberry Pi.
+type RpioDriver struct{}
+
+func NewRpioDriver() *RpioDriver {
+	return new(RpioDriver)
+}
+
+func (d *RpioDriver) Open() error {
+	return rpio.Open()
+}
+
+func (d *RpioDriver) SetOutput(pin uint8, high bool) error {
+	p := rpio.Pin(pin)
+	p.Mode(rpio.Output)
+	if high {
+		p.High()
+	} else {
+		p.Low()
+	}
+	return nil
+}
+
+func (d *RpioDriver) ReadPin(pin uint8) (bool, error) {
+	return rpio.Pin(pin).Read() == rpio.High, nil
+}
+
+func (d *RpioDriver) ReadInput(pin uint8) (bool, error) {
+	p := rpio.Pin(pin)
+	p.Mode(rpio.Input)
+	return p.Read() == rpio.High, nil
+}
+
+// Hardware PWM is only available on GPIO 12, 13, 18 and 19 and needs root as it uses /dev/mem
+func (d *RpioDriver) SetPWM(pin uint8, frequency int, duty float32) error {
+	switch pin {
+	case 12, 13, 18, 19:
+	default:
+		return ErrPWMNotSupported
+	}
+	p := rpio.Pin(pin)
+	p.Mode(rpio.Pwm)
+	p.Freq(frequency * pwmCycleLength)
+	p.DutyCycle(uint32(duty*pwmCycleLength), pwmCycleLength)
+	return nil
+}
+
+// Number of PWM clock ticks in one cycle. Gives 1% resolution on the duty cycle.
+const pwmCycleLength = 100
+
+func (d *RpioDriver) Close() error {
+	return rpio.Close()
+}
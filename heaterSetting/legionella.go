@@ -0,0 +1,141 @@
+package heaterSetting
+
+import (
+	"encoding/json"
+	"github.com/golang/glog"
+	"os"
+	"time"
+)
+
+// Anti-legionella cycle. The tank must reach Temp at least once every IntervalDays. While a cycle is due surplus power
+// is allowed to heat the tank past its normal target up to Temp. If it still hasn't got there the heater is forced on
+// during the daily window starting at StartHour, drawing from the battery or grid if it has to.
+type LegionellaConfig struct {
+	Temp         int16  `json:"temp"`         // Deg C x 10. Default 60C
+	IntervalDays int    `json:"intervalDays"` // Default 7 days
+	StartHour    int    `json:"startHour"`    // Local hour of the day the forced heat window opens
+	WindowHours  int    `json:"windowHours"`  // How long the forced heat window stays open. Default 4 hours
+	StateFile    string `json:"stateFile"`    // Where the last successful cycle is recorded
+}
+
+const (
+	defaultLegionellaTemp         = 600
+	defaultLegionellaIntervalDays = 7
+	defaultLegionellaWindowHours  = 4
+)
+
+type legionella struct {
+	temp      int16
+	interval  time.Duration
+	startHour int
+	window    time.Duration
+	stateFile string
+	lastCycle time.Time // When the tank last reached temp
+	forcing   bool      // The forced heat window is open and the cycle is still due
+}
+
+// What we keep in the state file
+type legionellaState struct {
+	LastCycle time.Time `json:"lastCycle"`
+}
+
+func newLegionella(config LegionellaConfig) *legionella {
+	l := &legionella{temp: config.Temp, startHour: config.StartHour, stateFile: config.StateFile}
+	if l.temp == 0 {
+		l.temp = defaultLegionellaTemp
+	}
+	days := config.IntervalDays
+	if days <= 0 {
+		days = defaultLegionellaIntervalDays
+	}
+	l.interval = time.Duration(days) * 24 * time.Hour
+	hours := config.WindowHours
+	if hours <= 0 {
+		hours = defaultLegionellaWindowHours
+	}
+	l.window = time.Duration(hours) * time.Hour
+	l.load()
+	return l
+}
+
+// Read the last successful cycle. If we don't know when it was the cycle is due now.
+func (l *legionella) load() {
+	if l.stateFile == "" {
+		return
+	}
+	f, err := os.Open(l.stateFile)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		glog.Errorf("Failed to read the legionella state from %s - %s", l.stateFile, err)
+		return
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	var state legionellaState
+	err = json.NewDecoder(f).Decode(&state)
+	if err != nil {
+		glog.Errorf("Failed to read the legionella state from %s - %s", l.stateFile, err)
+		return
+	}
+	l.lastCycle = state.LastCycle
+}
+
+// Record the last successful cycle. Called after the heater is unlocked so the file is not written with it held.
+func (l *legionella) save(lastCycle time.Time) {
+	if l.stateFile == "" {
+		return
+	}
+	err := writeJSONFile(l.stateFile, legionellaState{lastCycle})
+	if err != nil {
+		glog.Errorf("Failed to save the legionella state to %s - %s", l.stateFile, err)
+		glog.Flush()
+	}
+}
+
+func (l *legionella) isDue(now time.Time) bool {
+	return now.Sub(l.lastCycle) >= l.interval
+}
+
+// True if now is inside today's forced heat window. The window may run past midnight.
+func (l *legionella) inWindow(now time.Time) bool {
+	start := time.Date(now.Year(), now.Month(), now.Day(), l.startHour, 0, 0, 0, now.Location())
+	if start.After(now) {
+		start = start.AddDate(0, 0, -1)
+	}
+	return now.Sub(start) < l.window
+}
+
+// Record a successful cycle if the tank is hot enough and work out whether the heater should be forced on. measured is
+// false if t is a stand-in for a temperature we couldn't read, which must never count as a cycle.
+// Returns the temperature the tank should be heated to while the cycle is due, or 0 if it isn't, and whether a cycle
+// has just completed and needs saving.
+func (l *legionella) update(t int16, measured bool, now time.Time) (target int16, completed bool) {
+	if measured && (t >= l.temp) && l.isDue(now) {
+		glog.Infof("Legionella cycle complete. Tank reached %0.1fC", float32(t)/10)
+		l.lastCycle = now
+		completed = true
+	}
+	if !l.isDue(now) {
+		l.forcing = false
+		return 0, completed
+	}
+	forcing := l.inWindow(now)
+	if forcing && !l.forcing {
+		glog.Infof("Legionella cycle overdue. Forcing the heater on to reach %0.1fC", float32(l.temp)/10)
+	}
+	l.forcing = forcing
+	return l.temp, completed
+}
+
+// When the tank last reached the legionella temperature, whether a cycle is due and whether the heater is being forced
+// on to complete it. Heaters without a legionella cycle always return a zero time and false.
+func (h *HeaterSetting) GetLegionella() (lastCycle time.Time, due bool, forcing bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.legionella == nil {
+		return time.Time{}, false, false
+	}
+	return h.legionella.lastCycle, h.legionella.isDue(time.Now()), h.legionella.forcing && h.enabled
+}
@@ -0,0 +1,166 @@
+package heaterSetting
+
+import (
+	"encoding/json"
+	"github.com/golang/glog"
+	"os"
+	"time"
+)
+
+// Run time accounting for each heater element. An element whose SSR has failed shows up as one that never runs, or
+// never stops, compared with the others. Run times are also used to share the work between elements of equal power.
+
+// How often the run times are written to the state file
+const elementSaveInterval = 5 * time.Minute
+
+// Totals for one element
+type ElementStats struct {
+	Pin       uint8   `json:"pin"`
+	Watts     int     `json:"watts"`
+	On        bool    `json:"on"`
+	OnSeconds float64 `json:"onSeconds"` // Total time the element has been switched on
+	Cycles    uint64  `json:"cycles"`    // Number of times the element has been switched on
+	KWh       float64 `json:"kWh"`       // Estimated from the time on and the element's rated power
+}
+
+type elementRuntime struct {
+	ElementStats
+	since time.Time // When the element was last switched on
+}
+
+// What we keep in the state file
+type elementState struct {
+	Elements []ElementStats `json:"elements"`
+}
+
+// Set up the counters and load any saved totals. Must be called after the elements are known.
+func (h *HeaterSetting) newElementStats(stateFile string) {
+	h.elementStateFile = stateFile
+	h.elementStats = make([]elementRuntime, len(h.elements))
+	for i, e := range h.elements {
+		h.elementStats[i].Pin = e.Pin
+		h.elementStats[i].Watts = e.Watts
+	}
+	h.loadElementStats()
+	if stateFile != "" {
+		go func() {
+			for {
+				time.Sleep(elementSaveInterval)
+				h.SaveElementStats()
+			}
+		}()
+	}
+}
+
+// Totals are matched to elements by pin so reordering the elements in the configuration keeps them
+func (h *HeaterSetting) loadElementStats() {
+	if h.elementStateFile == "" {
+		return
+	}
+	f, err := os.Open(h.elementStateFile)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		glog.Errorf("Failed to read the element run times from %s - %s", h.elementStateFile, err)
+		return
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	var state elementState
+	err = json.NewDecoder(f).Decode(&state)
+	if err != nil {
+		glog.Errorf("Failed to read the element run times from %s - %s", h.elementStateFile, err)
+		return
+	}
+	for _, saved := range state.Elements {
+		for i := range h.elementStats {
+			if h.elementStats[i].Pin == saved.Pin {
+				h.elementStats[i].OnSeconds = saved.OnSeconds
+				h.elementStats[i].Cycles = saved.Cycles
+				h.elementStats[i].KWh = saved.KWh
+			}
+		}
+	}
+}
+
+// Write the run times to the state file
+func (h *HeaterSetting) SaveElementStats() {
+	if h.elementStateFile == "" {
+		return
+	}
+	err := writeJSONFile(h.elementStateFile, elementState{h.GetElementStats()})
+	if err != nil {
+		glog.Errorf("Failed to save the element run times to %s - %s", h.elementStateFile, err)
+		glog.Flush()
+	}
+}
+
+// Count the elements switched on and off by the new mask. Must be called with the lock held.
+func (h *HeaterSetting) recordElements(mask uint8) {
+	now := time.Now()
+	for i := range h.elementStats {
+		e := &h.elementStats[i]
+		on := ((mask >> uint(i)) & 1) > 0
+		if on == e.On {
+			continue
+		}
+		if on {
+			e.Cycles++
+			e.since = now
+		} else {
+			e.accumulate(now)
+		}
+		e.On = on
+	}
+}
+
+// Add the time since the element was switched on to its totals
+func (e *elementRuntime) accumulate(now time.Time) {
+	seconds := now.Sub(e.since).Seconds()
+	e.OnSeconds += seconds
+	e.KWh += seconds * float64(e.Watts) / 3600000
+	e.since = now
+}
+
+// Total run time in seconds of the elements in mask including the time they have been on so far. Must be called with
+// the lock held.
+func (h *HeaterSetting) maskSeconds(mask uint8, now time.Time) float64 {
+	total := 0.0
+	for i, e := range h.elementStats {
+		if ((mask >> uint(i)) & 1) > 0 {
+			total += e.OnSeconds
+			if e.On {
+				total += now.Sub(e.since).Seconds()
+			}
+		}
+	}
+	return total
+}
+
+// Choose the combination of elements for a level that has run the least. Must be called with the lock held.
+func (h *HeaterSetting) leastUsed(setting uint8) uint8 {
+	now := time.Now()
+	best := h.alternatives[setting][0]
+	for _, mask := range h.alternatives[setting][1:] {
+		if h.maskSeconds(mask, now) < h.maskSeconds(best, now) {
+			best = mask
+		}
+	}
+	return best
+}
+
+// Return the totals for every element up to now
+func (h *HeaterSetting) GetElementStats() []ElementStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	stats := make([]ElementStats, len(h.elementStats))
+	for i, e := range h.elementStats {
+		if e.On {
+			e.accumulate(now)
+		}
+		stats[i] = e.ElementStats
+	}
+	return stats
+}
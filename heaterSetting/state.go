@@ -0,0 +1,25 @@
+package heaterSetting
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// Write v to path as JSON. It goes to a temporary file first so a crash can't leave a half written state file. Don't
+// call this with the heater locked.
+func writeJSONFile(path string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(path+".tmp", b, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,31 @@
+package heaterSetting
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A completed legionella cycle is saved and read back by the next heater
+func TestLegionellaState(t *testing.T) {
+	config := testConfig()
+	config.Legionella = &LegionellaConfig{Temp: 600, StateFile: filepath.Join(t.TempDir(), "state", "legionella.json")}
+	h, _ := newTestHeater(t, config)
+	if _, due, _ := h.GetLegionella(); !due {
+		t.Fatal("a heater with no saved cycle doesn't have one due")
+	}
+	h.SetHotTankTemp(610)
+	lastCycle, due, _ := h.GetLegionella()
+	if due {
+		t.Fatal("the cycle is still due after the tank reached 61C")
+	}
+	if _, err := os.Stat(config.Legionella.StateFile + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("the temporary file was left behind - %v", err)
+	}
+
+	h, _ = newTestHeater(t, config)
+	saved, due, _ := h.GetLegionella()
+	if due || !saved.Equal(lastCycle) {
+		t.Errorf("read back a cycle at %s, due %v, want %s", saved, due, lastCycle)
+	}
+}
@@ -0,0 +1,270 @@
+package heaterSetting
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Supplies the tank temperature for a heater
+type TemperatureSource interface {
+	// Return the temperature (Deg C x 10) and when it was measured
+	GetTemperature() (temp int16, measured time.Time, err error)
+}
+
+// Temperature used when we can't get a current reading. It is high enough to turn the heater off.
+const unknownTemp = 1000
+
+// Describes where a heater gets its tank temperature from
+type TemperatureConfig struct {
+	Type            string   `json:"type"`            // sql, ds18b20, http or mqtt
+	IntervalSeconds int      `json:"intervalSeconds"` // How often to read the temperature. Default 1 second
+	MaxAgeSeconds   int      `json:"maxAgeSeconds"`   // Readings older than this are stale. Default 5 minutes
+	Query           string   `json:"query"`           // sql - Must return the temperature (Deg C x 10) and its age in seconds
+	Devices         []string `json:"devices"`         // ds18b20 - 1-wire device IDs. The hottest is used
+	URL             string   `json:"url"`             // http - Address returning JSON. mqtt - Broker address
+	Field           string   `json:"field"`           // http and mqtt - Dotted path to the temperature (Deg C) in the JSON
+	Topic           string   `json:"topic"`           // mqtt - Topic the temperature is published to
+	Username        string   `json:"username"`        // mqtt
+	Password        string   `json:"password"`        // mqtt
+}
+
+// The hottest of the three hot tank sensors logged by the solar controller
+const defaultTemperatureQuery = "select greatest(TSH0, TSH1, TSH2) as maxtemp, timestampdiff(second, TIMESTAMP, now()) as age from chillii_analogue_input order by TIMESTAMP desc limit 1"
+
+// The original hot tank temperature from the database
+func DefaultTemperatureConfig() TemperatureConfig {
+	return TemperatureConfig{Type: "sql", Query: defaultTemperatureQuery}
+}
+
+// Create the temperature source described by config. db returns the current database connection for sql sources.
+func NewTemperatureSource(config TemperatureConfig, db func() *sql.DB) (TemperatureSource, error) {
+	switch config.Type {
+	case "sql":
+		query := config.Query
+		if query == "" {
+			query = defaultTemperatureQuery
+		}
+		return &SQLSource{db, query}, nil
+	case "ds18b20":
+		if len(config.Devices) == 0 {
+			return nil, fmt.Errorf("no DS18B20 devices given")
+		}
+		return &DS18B20Source{config.Devices}, nil
+	case "http":
+		if config.URL == "" {
+			return nil, fmt.Errorf("no URL given for the HTTP temperature source")
+		}
+		return &HTTPSource{config.URL, config.Field, &http.Client{Timeout: 10 * time.Second}}, nil
+	case "mqtt":
+		return NewMQTTSource(config.URL, config.Topic, config.Field, config.Username, config.Password)
+	}
+	return nil, fmt.Errorf("unknown temperature source type %s", config.Type)
+}
+
+// Keep the heater's tank temperature up to date from source. If the reading fails or is older than maxAge the
+// heater is given a temperature that turns it off.
+func (h *HeaterSetting) WatchTemperature(source TemperatureSource, interval time.Duration, maxAge time.Duration) {
+	for {
+		t, measured, err := source.GetTemperature()
+		stale := true
+		if err != nil {
+			if !h.GetTemperatureStale() {
+				glog.Errorf("Error fetching hot tank temperature - %s", err)
+				glog.Flush()
+			}
+		} else if time.Since(measured) > maxAge {
+			if !h.GetTemperatureStale() {
+				glog.Errorf("Hot tank temperature is stale. Last reading was at %s", measured.Format(time.RFC3339))
+				glog.Flush()
+			}
+		} else {
+			stale = false
+		}
+		h.mu.Lock()
+		h.temperatureStale = stale
+		h.mu.Unlock()
+		if stale {
+			h.SetHotTankTemp(unknownTemp) // Be safe. If we can't get the temperature assume it is boiling to shut down the heater.
+		} else {
+			h.SetHotTankTemp(t)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// True if the last temperature reading failed or was too old
+func (h *HeaterSetting) GetTemperatureStale() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.temperatureStale
+}
+
+// Passes on the temperature another heater has been given so more than one thing can use the same sensor
+type HeaterSource struct {
+	heater *HeaterSetting
+}
+
+func NewHeaterSource(h *HeaterSetting) *HeaterSource {
+	return &HeaterSource{h}
+}
+
+func (s *HeaterSource) GetTemperature() (int16, time.Time, error) {
+	if s.heater.GetTemperatureStale() {
+		return 0, time.Time{}, fmt.Errorf("the heater temperature is stale")
+	}
+	return s.heater.GetHotTankTemp(), time.Now(), nil
+}
+
+// Reads the temperature from the database
+type SQLSource struct {
+	db    func() *sql.DB
+	query string
+}
+
+func (s *SQLSource) GetTemperature() (int16, time.Time, error) {
+	db := s.db()
+	if db == nil {
+		return 0, time.Time{}, fmt.Errorf("not connected to the database")
+	}
+	var temp int16
+	var age int64
+	err := db.QueryRow(s.query).Scan(&temp, &age)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return temp, time.Now().Add(-time.Duration(age) * time.Second), nil
+}
+
+// Reads DS18B20 1-wire sensors through the w1-therm kernel driver
+type DS18B20Source struct {
+	devices []string
+}
+
+const w1Devices = "/sys/bus/w1/devices"
+
+func (s *DS18B20Source) GetTemperature() (int16, time.Time, error) {
+	var hottest int16
+	for i, device := range s.devices {
+		t, err := readDS18B20(filepath.Join(w1Devices, device, "w1_slave"))
+		if err != nil {
+			return 0, time.Time{}, fmt.Errorf("DS18B20 %s - %s", device, err)
+		}
+		if (i == 0) || (t > hottest) {
+			hottest = t
+		}
+	}
+	return hottest, time.Now(), nil
+}
+
+// The w1_slave file looks like this. The first line must end in YES and t= gives millidegrees.
+//
+//	72 01 4b 46 7f ff 0e 10 57 : crc=57 YES
+//	72 01 4b 46 7f ff 0e 10 57 t=23125
+func readDS18B20(path string) (int16, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() || !strings.HasSuffix(strings.TrimSpace(scanner.Text()), "YES") {
+		return 0, fmt.Errorf("CRC check failed")
+	}
+	if !scanner.Scan() {
+		return 0, fmt.Errorf("no temperature line")
+	}
+	line := scanner.Text()
+	i := strings.Index(line, "t=")
+	if i < 0 {
+		return 0, fmt.Errorf("no temperature in %s", line)
+	}
+	milli, err := strconv.Atoi(strings.TrimSpace(line[i+2:]))
+	if err != nil {
+		return 0, err
+	}
+	return int16(milli / 100), nil
+}
+
+// Fetches the temperature (Deg C) from a JSON document served over HTTP
+type HTTPSource struct {
+	url    string
+	field  string
+	client *http.Client
+}
+
+func (s *HTTPSource) GetTemperature() (int16, time.Time, error) {
+	resp, err := s.client.Get(s.url)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return 0, time.Time{}, fmt.Errorf("%s returned %s", s.url, resp.Status)
+	}
+	var doc interface{}
+	err = json.NewDecoder(resp.Body).Decode(&doc)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	t, err := jsonTemperature(doc, s.field)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return t, time.Now(), nil
+}
+
+// Find the number at the dotted path in a decoded JSON document and return it as Deg C x 10.
+// An empty path means the document itself is the number.
+func jsonTemperature(doc interface{}, path string) (int16, error) {
+	if path != "" {
+		for _, key := range strings.Split(path, ".") {
+			m, ok := doc.(map[string]interface{})
+			if !ok {
+				return 0, fmt.Errorf("%s not found", path)
+			}
+			if doc, ok = m[key]; !ok {
+				return 0, fmt.Errorf("%s not found", path)
+			}
+		}
+	}
+	switch v := doc.(type) {
+	case float64:
+		return int16(v * 10), nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return 0, err
+		}
+		return int16(f * 10), nil
+	}
+	return 0, fmt.Errorf("%s is not a number", path)
+}
+
+// How often to read the temperature
+func (c TemperatureConfig) GetInterval() time.Duration {
+	if c.IntervalSeconds <= 0 {
+		return time.Second
+	}
+	return time.Duration(c.IntervalSeconds) * time.Second
+}
+
+// How old a reading can be before the heater is turned off
+func (c TemperatureConfig) GetMaxAge() time.Duration {
+	if c.MaxAgeSeconds <= 0 {
+		return 5 * time.Minute
+	}
+	return time.Duration(c.MaxAgeSeconds) * time.Second
+}
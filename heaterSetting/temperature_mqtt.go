@@ -0,0 +1,112 @@
+package heaterSetting
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/eclipse/paho.mqtt.golang"
+	"github.com/golang/glog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long to wait for the broker at start up before carrying on without it
+const mqttConnectWait = 5 * time.Second
+
+// How often to try the broker again when it can't be reached
+const mqttRetryInterval = 10 * time.Second
+
+// Takes the temperature (Deg C) from messages published to an MQTT topic. The payload is either a plain number or a
+// JSON document with the temperature at field.
+//
+// The broker doesn't have to be up when we start. The connection is retried in the background and the temperature is
+// an error, so the heater treats it as stale, until the first message arrives.
+type MQTTSource struct {
+	field    string
+	temp     int16
+	measured time.Time
+	err      error
+	mu       sync.Mutex
+}
+
+func NewMQTTSource(broker string, topic string, field string, username string, password string) (*MQTTSource, error) {
+	if broker == "" || topic == "" {
+		return nil, fmt.Errorf("the MQTT temperature source needs a broker URL and a topic")
+	}
+	s := &MQTTSource{field: field, err: fmt.Errorf("no temperature received on %s yet", topic)}
+	host, _ := os.Hostname()
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(fmt.Sprintf("TeslaChargeControl-%s-%d", host, os.Getpid())).
+		SetUsername(username).
+		SetPassword(password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(mqttRetryInterval).
+		SetOnConnectHandler(func(c mqtt.Client) {
+			// Subscribe again every time we connect as the broker may have forgotten us
+			token := c.Subscribe(topic, 0, s.receive)
+			if token.Wait() && token.Error() != nil {
+				glog.Errorf("Failed to subscribe to %s - %s", topic, token.Error())
+				glog.Flush()
+			}
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			glog.Errorf("Lost the connection to the MQTT broker %s - %s", broker, err)
+			glog.Flush()
+		})
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(mqttConnectWait) {
+		glog.Errorf("Cannot reach the MQTT broker %s. Still trying. The temperature on %s is stale until it arrives.", broker, topic)
+		glog.Flush()
+		go func() {
+			token.Wait()
+			glog.Infof("Connected to the MQTT broker %s", broker)
+		}()
+	} else if token.Error() != nil {
+		return nil, token.Error()
+	}
+	return s, nil
+}
+
+func (s *MQTTSource) receive(_ mqtt.Client, msg mqtt.Message) {
+	t, err := parseMQTTTemperature(msg.Payload(), s.field)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.err = fmt.Errorf("bad temperature on %s - %s", msg.Topic(), err)
+		return
+	}
+	s.temp = t
+	s.measured = time.Now()
+	s.err = nil
+}
+
+func parseMQTTTemperature(payload []byte, field string) (int16, error) {
+	if field == "" {
+		f, err := strconv.ParseFloat(strings.TrimSpace(string(payload)), 64)
+		if err != nil {
+			return 0, err
+		}
+		return int16(f * 10), nil
+	}
+	var doc interface{}
+	err := json.Unmarshal(payload, &doc)
+	if err != nil {
+		return 0, err
+	}
+	return jsonTemperature(doc, field)
+}
+
+// Return the last temperature received. A bad message only counts as an error until a good one arrives.
+func (s *MQTTSource) GetTemperature() (int16, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil && s.measured.IsZero() {
+		return 0, time.Time{}, s.err
+	}
+	return s.temp, s.measured, nil
+}
@@ -0,0 +1,45 @@
+package heaterSetting
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseMQTTTemperature(t *testing.T) {
+	tests := []struct {
+		payload string
+		field   string
+		want    int16
+		err     bool
+	}{
+		{"61.5", "", 615, false},
+		{" 40\n", "", 400, false},
+		{"hot", "", 0, true},
+		{`{"tank": {"top": 55.2}}`, "tank.top", 552, false},
+		{`{"tank": 55.2}`, "top", 0, true},
+	}
+	for _, test := range tests {
+		got, err := parseMQTTTemperature([]byte(test.payload), test.field)
+		if (got != test.want) || ((err != nil) != test.err) {
+			t.Errorf("%q at %q gave %d, %v, want %d with error %v", test.payload, test.field, got, err, test.want, test.err)
+		}
+	}
+}
+
+// With the broker down the source is still made and reads as an error until a temperature arrives
+func TestMQTTBrokerDown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	_ = l.Close()
+
+	s, err := NewMQTTSource("tcp://"+address, "tank/temperature", "", "", "")
+	if err != nil {
+		t.Fatalf("no source without the broker - %s", err)
+	}
+	if _, _, err := s.GetTemperature(); err == nil {
+		t.Error("got a temperature before any message arrived")
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"TeslaChargeControl/diverters"
+	"sync"
+	"time"
+)
+
+// A day of recent readings kept in memory for the dashboard charts. The database keeps the long term history.
+
+const (
+	historyInterval = 30 * time.Second
+	historyLength   = int(24 * time.Hour / historyInterval)
+)
+
+type HistorySample struct {
+	Time            time.Time          `json:"time"`
+	FrequencyHz     float64            `json:"frequencyHz"`
+	SOC             float32            `json:"soc"`
+	BatteryAmps     float32            `json:"batteryAmps"`
+	CarAmps         float32            `json:"carAmps"`         // Current all the cars are drawing
+	AvailableAmps   float32            `json:"availableAmps"`   // Current available to the cars
+	DiverterWatts   int                `json:"diverterWatts"`   // Power going to every diverter
+	TankTemperature *float32           `json:"tankTemperature"` // Hot water tank. null if it couldn't be read
+	Temperatures    map[string]float32 `json:"temperatures"`    // Every diverter with a temperature that could be read
+}
+
+type sampleHistory struct {
+	samples []HistorySample // Ring buffer
+	next    int
+	full    bool
+	mu      sync.Mutex
+}
+
+var History = &sampleHistory{samples: make([]HistorySample, historyLength)}
+
+func (h *sampleHistory) add(s HistorySample) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.samples[h.next] = s
+	h.next++
+	if h.next == len(h.samples) {
+		h.next = 0
+		h.full = true
+	}
+}
+
+// Return the samples taken after since, oldest first
+func (h *sampleHistory) GetSince(since time.Time) []HistorySample {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var ordered []HistorySample
+	if h.full {
+		ordered = append(ordered, h.samples[h.next:]...)
+	}
+	ordered = append(ordered, h.samples[:h.next]...)
+	result := make([]HistorySample, 0, len(ordered))
+	for _, s := range ordered {
+		if s.Time.After(since) {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+func takeSample() HistorySample {
+	current, maxAmps := TeslaParameters.GetValues()
+	s := HistorySample{
+		Time:          time.Now(),
+		FrequencyHz:   iValues.GetFrequency(),
+		SOC:           iValues.GetSOC(),
+		BatteryAmps:   iValues.GetAmps(),
+		CarAmps:       current,
+		AvailableAmps: maxAmps,
+		DiverterWatts: Diverters.GetWatts(),
+		Temperatures:  make(map[string]float32),
+	}
+	hasTemperature := make(map[string]bool)
+	for _, d := range Config.GetDiverters() {
+		hasTemperature[d.Name] = d.GetTemperature() != nil
+	}
+	// The hot tank is the hot water tank or the first diverter with a temperature if there isn't one
+	tank := ""
+	for _, d := range Diverters.GetAll() {
+		if !hasTemperature[d.Name] {
+			continue
+		}
+		if (tank == "") || (d.Name == diverters.HotTank) {
+			tank = d.Name
+		}
+		if !d.Heater.GetTemperatureStale() {
+			s.Temperatures[d.Name] = float32(d.Heater.GetHotTankTemp()) / 10
+		}
+	}
+	if t, found := s.Temperatures[tank]; found {
+		s.TankTemperature = &t
+	}
+	return s
+}
+
+// Record a sample every so often and push it to the live stream as a history event
+func recordHistory() {
+	for {
+		s := takeSample()
+		History.add(s)
+		Events.Publish("history", s)
+		time.Sleep(historyInterval)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"TeslaChargeControl/config"
+	"TeslaChargeControl/diverters"
+	"TeslaChargeControl/heaterSetting"
+	"testing"
+)
+
+type testTank struct {
+	name     string
+	priority int
+	hasTemp  bool
+	temp     int16
+}
+
+// Set up the diverters as startUp would with each tank at its temperature
+func setUpTanks(tanks []testTank) {
+	Config = new(config.Config)
+	Diverters = diverters.New()
+	for _, tank := range tanks {
+		c := heaterSetting.Config{Elements: []heaterSetting.Element{{Pin: 6, Watts: 2500}}, NoTempLimit: !tank.hasTemp}
+		if tank.hasTemp {
+			c.Temperature = &heaterSetting.TemperatureConfig{Type: "mqtt"}
+		}
+		Config.Diverters = append(Config.Diverters, config.Diverter{Name: tank.name, Priority: tank.priority, Config: c})
+		h := heaterSetting.New(heaterSetting.NewFakeDriver(), c)
+		h.SetHotTankTemp(tank.temp)
+		Diverters.Add(tank.name, tank.priority, h)
+	}
+}
+
+func TestTakeSampleTemperatures(t *testing.T) {
+	tests := []struct {
+		name  string
+		tanks []testTank
+		tank  float32 // 0 for none
+		temps map[string]float32
+	}{
+		{"hot water tank", []testTank{{diverters.HotTank, 1, true, 550}, {"tank2", 0, true, 400}}, 55, map[string]float32{diverters.HotTank: 55, "tank2": 40}},
+		{"hot water tank without a temperature", []testTank{{diverters.HotTank, 0, false, 0}, {"pool", 1, false, 0}, {"tank2", 2, true, 400}}, 40, map[string]float32{"tank2": 40}},
+		{"no temperatures", []testTank{{diverters.HotTank, 0, false, 0}}, 0, map[string]float32{}},
+	}
+	for _, test := range tests {
+		setUpTanks(test.tanks)
+		s := takeSample()
+		var tank float32
+		if s.TankTemperature != nil {
+			tank = *s.TankTemperature
+		}
+		if tank != test.tank {
+			t.Errorf("%s: tank temperature %0.1f, want %0.1f", test.name, tank, test.tank)
+		}
+		if len(s.Temperatures) != len(test.temps) {
+			t.Errorf("%s: temperatures %v, want %v", test.name, s.Temperatures, test.temps)
+			continue
+		}
+		for name, want := range test.temps {
+			if got, found := s.Temperatures[name]; !found || (got != want) {
+				t.Errorf("%s: temperatures %v, want %v", test.name, s.Temperatures, test.temps)
+				break
+			}
+		}
+	}
+}
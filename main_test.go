@@ -0,0 +1,75 @@
+package main
+
+import (
+	"TeslaChargeControl/config"
+	"TeslaChargeControl/heaterSetting"
+	"TeslaChargeControl/twcMessage"
+	"TeslaChargeControl/twcSimulator"
+	"github.com/goburrow/serial"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Wait up to timeout for ok to be true
+func waitFor(t *testing.T, timeout time.Duration, what string, ok func() bool) {
+	t.Helper()
+	end := time.Now().Add(timeout)
+	for !ok() {
+		if time.Now().After(end) {
+			t.Fatalf("gave up waiting for %s after %s", what, timeout)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Run the master against a simulated charger with no inverters, database or heaters
+func TestMasterWithSimulator(t *testing.T) {
+	charger := twcSimulator.NewCharger(0x1234, twcMessage.ProtocolVersion2, 3200, "SIM1234")
+	charger.PlugIn("5YJ3E1EA7JF000001", 3200)
+	sim, err := twcSimulator.New(charger)
+	if err != nil {
+		t.Skipf("no pseudo terminal - %s", err)
+	}
+	defer func() {
+		_ = sim.Close()
+	}()
+	p, err := serial.Open(&serial.Config{Address: sim.GetPortName(), BaudRate: 9600, DataBits: 8, StopBits: 1, Parity: "N", Timeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	stateDir = dir
+	Config, err = config.Load(filepath.Join(dir, "missing.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	startUp(dependencies{port: p, gpio: heaterSetting.NewFakeDriver()})
+	TeslaParameters.SetMaxAmps(16)
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		runMaster(done)
+		close(stopped)
+	}()
+	defer func() {
+		close(done)
+		<-stopped
+		_ = p.Close()
+	}()
+
+	waitFor(t, 10*time.Second, "the charger to link up", charger.IsLinked)
+	waitFor(t, 5*time.Second, "the charger's heartbeats", func() bool {
+		return findSlave(getSlaves(), 0x1234) >= 0
+	})
+	waitFor(t, 5*time.Second, "the charger to be allowed 16A", func() bool {
+		return charger.GetAllowed() == 1600
+	})
+
+	TeslaParameters.SetMaxAmps(20)
+	waitFor(t, 5*time.Second, "the charger to follow the setpoint to 20A", func() bool {
+		return charger.GetAllowed() == 2000
+	})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"TeslaChargeControl/twcMessage"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"sync/atomic"
+)
+
+// Prometheus metrics served on /metrics. Gauges are read from the live state when Prometheus scrapes so they are
+// never out of date and cars that have gone away simply drop out.
+
+const metricsNamespace = "teslacharge"
+
+// Error counts
+var (
+	invalidFrames  uint64 // Complete frames with a bad checksum
+	unknownCodes   uint64 // Valid frames with a message code we don't handle
+	slaveTimeouts  uint64 // Slaves dropped because their heartbeats stopped
+	databaseErrors uint64 // Failed connections and writes
+)
+
+func newDesc(name string, help string, labels ...string) *prometheus.Desc {
+	return prometheus.NewDesc(metricsNamespace+"_"+name, help, labels, nil)
+}
+
+var (
+	frequencyDesc      = newDesc("inverter_frequency_hertz", "AC frequency set by the inverter.")
+	setpointDesc       = newDesc("battery_setpoint_volts", "Battery charge voltage setpoint.")
+	batteryVoltsDesc   = newDesc("battery_volts", "Battery voltage.")
+	batteryAmpsDesc    = newDesc("battery_amps", "Battery current. Positive when discharging.")
+	socDesc            = newDesc("battery_soc_percent", "Battery state of charge.")
+	availableAmpsDesc  = newDesc("tesla_available_amps", "Current available to share between the cars.")
+	chargingAmpsDesc   = newDesc("tesla_charging_amps", "Current all the cars are drawing.")
+	systemMaxAmpsDesc  = newDesc("tesla_system_max_amps", "Most current the wiring allows for all the cars.")
+	carCurrentDesc     = newDesc("car_current_amps", "Current the car is drawing.", "address")
+	carAllowedDesc     = newDesc("car_allowed_amps", "Current the car has been offered.", "address")
+	carStatusDesc      = newDesc("car_status", "Status code reported by the wall charger.", "address", "status")
+	heaterSettingDesc  = newDesc("heater_setting", "Heater power level.", "diverter")
+	heaterWattsDesc    = newDesc("heater_watts", "Power going to the heater.", "diverter")
+	heaterPumpDesc     = newDesc("heater_pump", "1 if the heater circulation pump is on.", "diverter")
+	heaterEnabledDesc  = newDesc("heater_enabled", "1 if the heater is allowed to run.", "diverter")
+	heaterTempDesc     = newDesc("heater_temperature_celsius", "Tank temperature.", "diverter")
+	solarPumpDesc      = newDesc("solar_pump_running", "1 if the solar collector pump is running.")
+	solarPumpSpeedDesc = newDesc("solar_pump_speed_ratio", "Solar collector pump speed from 0 to 1.")
+	fanDesc            = newDesc("fan_on", "1 if the cooling fan is on.")
+	invalidFramesDesc  = newDesc("rs485_invalid_frames_total", "RS485 frames thrown away. reason is checksum or framing.", "reason")
+	unknownCodesDesc   = newDesc("rs485_unknown_codes_total", "RS485 messages with a code we don't handle.")
+	slaveTimeoutsDesc  = newDesc("slave_timeouts_total", "Wall chargers dropped because they stopped answering.")
+	databaseErrorsDesc = newDesc("database_errors_total", "Failed database connections and writes.")
+)
+
+type metricsCollector struct{}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (metricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{frequencyDesc, setpointDesc, batteryVoltsDesc, batteryAmpsDesc, socDesc,
+		availableAmpsDesc, chargingAmpsDesc, systemMaxAmpsDesc, carCurrentDesc, carAllowedDesc,
+		carStatusDesc, heaterSettingDesc, heaterWattsDesc, heaterPumpDesc, heaterEnabledDesc, heaterTempDesc,
+		solarPumpDesc, solarPumpSpeedDesc, fanDesc, invalidFramesDesc, unknownCodesDesc, slaveTimeoutsDesc,
+		databaseErrorsDesc} {
+		ch <- d
+	}
+}
+
+func (metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	gauge := func(d *prometheus.Desc, v float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, v, labels...)
+	}
+	counter := func(d *prometheus.Desc, v uint64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, float64(v), labels...)
+	}
+
+	gauge(frequencyDesc, iValues.GetFrequency())
+	gauge(setpointDesc, float64(iValues.GetSetPoint()))
+	gauge(batteryVoltsDesc, float64(iValues.GetVolts()))
+	gauge(batteryAmpsDesc, float64(iValues.GetAmps()))
+	gauge(socDesc, float64(iValues.GetSOC()))
+	current, maxAmps := TeslaParameters.GetValues()
+	gauge(availableAmpsDesc, float64(maxAmps))
+	gauge(chargingAmpsDesc, float64(current))
+	gauge(systemMaxAmpsDesc, float64(TeslaParameters.GetSystemMax()))
+	for _, s := range getSlaves() {
+		address := fmt.Sprintf("%04x", s.GetAddress())
+		gauge(carCurrentDesc, float64(s.GetCurrent())/100, address)
+		gauge(carAllowedDesc, float64(s.GetAllowed())/100, address)
+		gauge(carStatusDesc, float64(s.GetStatusCode()), address, s.GetStatus())
+	}
+
+	for _, d := range Diverters.GetAll() {
+		gauge(heaterSettingDesc, float64(d.Heater.GetSetting()), d.Name)
+		gauge(heaterWattsDesc, float64(d.Heater.GetWatts()), d.Name)
+		gauge(heaterPumpDesc, boolToFloat(d.Heater.GetPump()), d.Name)
+		gauge(heaterEnabledDesc, boolToFloat(d.Heater.GetEnabled() == "ON"), d.Name)
+		if !d.Heater.GetTemperatureStale() {
+			gauge(heaterTempDesc, float64(d.Heater.GetHotTankTemp())/10, d.Name)
+		}
+	}
+	if SolarPump != nil {
+		running, duty, _, _, _ := SolarPump.GetStatus()
+		gauge(solarPumpDesc, boolToFloat(running))
+		gauge(solarPumpSpeedDesc, float64(duty))
+	}
+	if Fan != nil {
+		gauge(fanDesc, boolToFloat(Fan.GetOn()))
+	}
+
+	counter(invalidFramesDesc, atomic.LoadUint64(&invalidFrames), "checksum")
+	counter(invalidFramesDesc, twcMessage.GetDiscardedFrames(), "framing")
+	counter(unknownCodesDesc, atomic.LoadUint64(&unknownCodes))
+	counter(slaveTimeoutsDesc, atomic.LoadUint64(&slaveTimeouts))
+	counter(databaseErrorsDesc, atomic.LoadUint64(&databaseErrors))
+}
+
+func init() {
+	prometheus.MustRegister(metricsCollector{})
+}
@@ -0,0 +1,272 @@
+package pumpControl
+
+import (
+	"TeslaChargeControl/heaterSetting"
+	"fmt"
+	"github.com/golang/glog"
+	"sync"
+	"time"
+)
+
+// Drives the solar collector pump and the cooling fan.
+//
+// The solar pump is a differential controller. It starts when the collector is StartDiff hotter than the tank and
+// stops when the difference falls below StopDiff. In between its PWM speed rises from MinDuty at StopDiff to MaxDuty
+// at FullSpeedDiff. It also stops if the tank reaches MaxTankTemp or either temperature can't be read. If the GPIO
+// driver can't do PWM on the pin the pump is simply switched on and off.
+//
+// The fan cools the heater solid state relays. It runs while any heater element is on and for RunOnSeconds after.
+
+type SolarPumpConfig struct {
+	Pin             uint8                            `json:"pin"`             // PWM output to the pump
+	FrequencyHz     int                              `json:"frequencyHz"`     // PWM frequency. Default 1kHz
+	Inverted        bool                             `json:"inverted"`        // The pump runs fastest at 0% duty (heating profile pumps)
+	MinDuty         float32                          `json:"minDuty"`         // Slowest speed the pump will run at (0 to 1). Default 0.3
+	MaxDuty         float32                          `json:"maxDuty"`         // Fastest speed (0 to 1). Default 1
+	StartDiff       int16                            `json:"startDiff"`       // Deg C x 10. Default 8C
+	StopDiff        int16                            `json:"stopDiff"`        // Deg C x 10. Default 4C
+	FullSpeedDiff   int16                            `json:"fullSpeedDiff"`   // Deg C x 10. Default 20C
+	MaxTankTemp     int16                            `json:"maxTankTemp"`     // Deg C x 10. Default 95C
+	IntervalSeconds int                              `json:"intervalSeconds"` // How often to adjust the speed. Default 5 seconds
+	Collector       heaterSetting.TemperatureConfig  `json:"collector"`       // Where the collector temperature comes from
+	Tank            *heaterSetting.TemperatureConfig `json:"tank"`            // Where the tank temperature comes from. Leave out to use the hot tank heater's
+}
+
+type FanConfig struct {
+	Pin          uint8 `json:"pin"`
+	ActiveHigh   bool  `json:"activeHigh"`   // The fan runs when the output is high
+	RunOnSeconds int   `json:"runOnSeconds"` // How long the fan keeps going after the elements go off. Default 60 seconds
+}
+
+const (
+	defaultFrequency     = 1000
+	defaultMinDuty       = 0.3
+	defaultMaxDuty       = 1.0
+	defaultStartDiff     = 80
+	defaultStopDiff      = 40
+	defaultFullSpeedDiff = 200
+	defaultMaxTankTemp   = 950
+	defaultInterval      = 5 * time.Second
+	defaultFanRunOn      = time.Minute
+)
+
+type SolarPump struct {
+	gpio          heaterSetting.OutputDriver
+	config        SolarPumpConfig
+	collector     heaterSetting.TemperatureSource
+	tank          heaterSetting.TemperatureSource
+	maxAge        time.Duration
+	interval      time.Duration
+	running       bool
+	duty          float32 // Current speed (0 to 1)
+	collectorTemp int16
+	tankTemp      int16
+	fault         bool // A temperature could not be read
+	noPWM         bool // The driver can't do PWM on the pin so we switch it instead
+	stopped       bool // Stopped for good when shutting down
+	mu            sync.Mutex
+}
+
+func NewSolarPump(gpio heaterSetting.OutputDriver, config SolarPumpConfig, collector heaterSetting.TemperatureSource, tank heaterSetting.TemperatureSource) *SolarPump {
+	if config.FrequencyHz <= 0 {
+		config.FrequencyHz = defaultFrequency
+	}
+	if config.MinDuty <= 0 {
+		config.MinDuty = defaultMinDuty
+	}
+	if config.MaxDuty <= 0 {
+		config.MaxDuty = defaultMaxDuty
+	}
+	if config.StartDiff == 0 {
+		config.StartDiff = defaultStartDiff
+	}
+	if config.StopDiff == 0 {
+		config.StopDiff = defaultStopDiff
+	}
+	if config.FullSpeedDiff <= config.StopDiff {
+		config.FullSpeedDiff = defaultFullSpeedDiff
+	}
+	if config.MaxTankTemp == 0 {
+		config.MaxTankTemp = defaultMaxTankTemp
+	}
+	p := &SolarPump{gpio: gpio, config: config, collector: collector, tank: tank}
+	p.maxAge = config.Collector.GetMaxAge()
+	p.interval = time.Duration(config.IntervalSeconds) * time.Second
+	if p.interval <= 0 {
+		p.interval = defaultInterval
+	}
+	p.setSpeed(0)
+	return p
+}
+
+// Adjust the pump speed for ever
+func (p *SolarPump) Run() {
+	for {
+		collector, err := p.read(p.collector)
+		if err != nil {
+			p.update(0, 0, err)
+		} else {
+			tank, err := p.read(p.tank)
+			p.update(collector, tank, err)
+		}
+		time.Sleep(p.interval)
+	}
+}
+
+func (p *SolarPump) read(source heaterSetting.TemperatureSource) (int16, error) {
+	t, measured, err := source.GetTemperature()
+	if err != nil {
+		return 0, err
+	}
+	if time.Since(measured) > p.maxAge {
+		return 0, fmt.Errorf("the last reading was at %s", measured.Format(time.RFC3339))
+	}
+	return t, nil
+}
+
+func (p *SolarPump) update(collector int16, tank int16, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		return
+	}
+	if err != nil {
+		if !p.fault {
+			glog.Errorf("Stopping the solar pump. Cannot read the temperatures - %s", err)
+			glog.Flush()
+		}
+		p.fault = true
+		p.running = false
+		p.setSpeed(0)
+		return
+	}
+	p.fault = false
+	p.collectorTemp = collector
+	p.tankTemp = tank
+	diff := collector - tank
+	switch {
+	case tank >= p.config.MaxTankTemp:
+		if p.running {
+			glog.Infof("Stopping the solar pump. The tank is at %0.1fC", float32(tank)/10)
+		}
+		p.running = false
+	case p.running && (diff < p.config.StopDiff):
+		p.running = false
+	case !p.running && (diff >= p.config.StartDiff):
+		p.running = true
+	}
+	if !p.running {
+		p.setSpeed(0)
+		return
+	}
+	fraction := float32(diff-p.config.StopDiff) / float32(p.config.FullSpeedDiff-p.config.StopDiff)
+	if fraction < 0 {
+		fraction = 0
+	} else if fraction > 1 {
+		fraction = 1
+	}
+	p.setSpeed(p.config.MinDuty + (p.config.MaxDuty-p.config.MinDuty)*fraction)
+}
+
+// Drive the pump output. duty is 0 to stop the pump.
+func (p *SolarPump) setSpeed(duty float32) {
+	p.duty = duty
+	if !p.noPWM {
+		out := duty
+		if p.config.Inverted {
+			out = 1 - duty
+		}
+		err := p.gpio.SetPWM(p.config.Pin, p.config.FrequencyHz, out)
+		if err == nil {
+			return
+		}
+		glog.Errorf("Cannot run the solar pump on pin %d with PWM so it will run at full speed. - %s", p.config.Pin, err)
+		glog.Flush()
+		p.noPWM = true
+	}
+	err := p.gpio.SetOutput(p.config.Pin, (duty > 0) != p.config.Inverted)
+	if err != nil {
+		glog.Errorf("Failed to set the solar pump. - %s\n", err)
+	}
+}
+
+// Stop the pump and keep it stopped. Used when shutting down.
+func (p *SolarPump) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopped = true
+	p.running = false
+	p.setSpeed(0)
+}
+
+// Pump state. duty is the speed from 0 to 1. Temperatures are Deg C x 10. fault is true if the temperatures
+// could not be read.
+func (p *SolarPump) GetStatus() (running bool, duty float32, collector int16, tank int16, fault bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.running, p.duty, p.collectorTemp, p.tankTemp, p.fault
+}
+
+type Fan struct {
+	gpio       heaterSetting.OutputDriver
+	pin        uint8
+	activeHigh bool
+	runOn      time.Duration
+	needed     func() bool // True while something needs cooling
+	on         bool
+	lastNeeded time.Time
+	stopped    bool // Stopped for good when shutting down
+	mu         sync.Mutex
+}
+
+// needed is polled every second and the fan runs while it returns true and for the run on time after
+func NewFan(gpio heaterSetting.OutputDriver, config FanConfig, needed func() bool) *Fan {
+	f := &Fan{gpio: gpio, pin: config.Pin, activeHigh: config.ActiveHigh, needed: needed}
+	f.runOn = time.Duration(config.RunOnSeconds) * time.Second
+	if f.runOn <= 0 {
+		f.runOn = defaultFanRunOn
+	}
+	f.set(false)
+	return f
+}
+
+func (f *Fan) Run() {
+	for {
+		f.mu.Lock()
+		if f.stopped {
+			f.mu.Unlock()
+			return
+		}
+		if f.needed() {
+			f.lastNeeded = time.Now()
+		}
+		on := time.Since(f.lastNeeded) < f.runOn
+		if on != f.on {
+			f.set(on)
+		}
+		f.mu.Unlock()
+		time.Sleep(time.Second)
+	}
+}
+
+func (f *Fan) set(on bool) {
+	f.on = on
+	err := f.gpio.SetOutput(f.pin, on == f.activeHigh)
+	if err != nil {
+		glog.Errorf("Failed to set the fan. - %s\n", err)
+	}
+}
+
+// Stop the fan and keep it stopped. Used when shutting down.
+func (f *Fan) Stop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stopped = true
+	f.set(false)
+}
+
+func (f *Fan) GetOn() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.on
+}
@@ -0,0 +1,23 @@
+-- Run time of each heater element. Logged when an element is switched on and every 15 minutes while it runs.
+--
+-- mysql logging < sql/heater_element.sql
+
+CREATE TABLE IF NOT EXISTS heater_element (
+	id         BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	logged     TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	diverter   VARCHAR(64) NOT NULL,
+	pin        TINYINT UNSIGNED NOT NULL,
+	on_seconds BIGINT UNSIGNED NOT NULL, -- Total time switched on
+	cycles     BIGINT UNSIGNED NOT NULL, -- Number of times switched on
+	kwh        DOUBLE NOT NULL,          -- Estimated from the time on and the element's rating
+	INDEX (diverter, pin, logged)
+);
+
+DROP PROCEDURE IF EXISTS log_heater_element;
+
+DELIMITER //
+CREATE PROCEDURE log_heater_element(IN pDiverter VARCHAR(64), IN pPin INT, IN pOnSeconds BIGINT, IN pCycles BIGINT, IN pKWh DOUBLE)
+BEGIN
+	INSERT INTO heater_element (diverter, pin, on_seconds, cycles, kwh) VALUES (pDiverter, pPin, pOnSeconds, pCycles, pKWh);
+END//
+DELIMITER ;
@@ -0,0 +1,20 @@
+-- Heater power level. log_heater_values records the elements that are on and the pump. This records the total power
+-- of the elements that are on whenever it changes.
+--
+-- mysql logging < sql/heater_watts.sql
+
+CREATE TABLE IF NOT EXISTS heater_watts (
+	id     BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	logged TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	watts  INT NOT NULL,
+	INDEX (logged)
+);
+
+DROP PROCEDURE IF EXISTS log_heater_watts;
+
+DELIMITER //
+CREATE PROCEDURE log_heater_watts(IN pWatts INT)
+BEGIN
+	INSERT INTO heater_watts (watts) VALUES (pWatts);
+END//
+DELIMITER ;
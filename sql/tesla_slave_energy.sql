@@ -0,0 +1,23 @@
+-- Meter readings from each wall charger's energy reports. Logged whenever a charger's lifetime energy changes.
+--
+-- mysql logging < sql/tesla_slave_energy.sql
+
+CREATE TABLE IF NOT EXISTS tesla_slave_energy (
+	id      BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	logged  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	address SMALLINT UNSIGNED NOT NULL, -- TWC address
+	kwh     INT UNSIGNED NOT NULL,      -- Lifetime energy
+	volts1  SMALLINT UNSIGNED NOT NULL, -- Phase voltages. 0 if the phase isn't connected
+	volts2  SMALLINT UNSIGNED NOT NULL,
+	volts3  SMALLINT UNSIGNED NOT NULL,
+	INDEX (address, logged)
+);
+
+DROP PROCEDURE IF EXISTS log_tesla_slave_energy;
+
+DELIMITER //
+CREATE PROCEDURE log_tesla_slave_energy(IN pAddress INT, IN pKWh INT, IN pVolts1 INT, IN pVolts2 INT, IN pVolts3 INT)
+BEGIN
+	INSERT INTO tesla_slave_energy (address, kwh, volts1, volts2, volts3) VALUES (pAddress, pKWh, pVolts1, pVolts2, pVolts3);
+END//
+DELIMITER ;
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"time"
+)
+
+// Live status for the web clients. The status is polled and an event is pushed whenever part of it changes. The power
+// management loop also pushes what it decided to do each time round.
+//
+// Event types are tesla, heater, diverters, pumps, inverter and decision. Each carries the same JSON as the matching
+// /api/v1 endpoint. Cars are part of the tesla event. A history event carries each new sample for the charts.
+
+// How often the status is checked for changes
+const streamPollInterval = 250 * time.Millisecond
+
+type Decision struct {
+	FrequencyHz   float64 `json:"frequencyHz"`
+	SetpointVolts float32 `json:"setpointVolts"`
+	BatteryVolts  float32 `json:"batteryVolts"`
+	BatteryAmps   float32 `json:"batteryAmps"`
+	SOC           float32 `json:"soc"`
+	CarAmps       float32 `json:"carAmps"`       // Current the cars were drawing
+	MaxAmps       float32 `json:"maxAmps"`       // Current available to the cars after the decision
+	DiverterWatts int     `json:"diverterWatts"` // Power going to the diverters after the decision
+	Action        string  `json:"action"`
+}
+
+func publishDecision(frequency float64, vSetpoint float32, vBatt float32, iBatt float32, soc float32, carCurrent float32, action string) {
+	Events.Publish("decision", Decision{
+		FrequencyHz:   frequency,
+		SetpointVolts: vSetpoint,
+		BatteryVolts:  vBatt,
+		BatteryAmps:   iBatt,
+		SOC:           soc,
+		CarAmps:       carCurrent,
+		MaxAmps:       TeslaParameters.GetMaxAmps(),
+		DiverterWatts: Diverters.GetWatts(),
+		Action:        action,
+	})
+}
+
+func streamStatus() {
+	for {
+		Events.PublishIfChanged("tesla", buildTeslaStatus())
+		Events.PublishIfChanged("heater", buildHeaterStatus(Heater))
+		Events.PublishIfChanged("diverters", buildDiverterStatus())
+		Events.PublishIfChanged("pumps", buildPumpStatus())
+		Events.PublishIfChanged("inverter", buildInverterStatus())
+		time.Sleep(streamPollInterval)
+	}
+}
@@ -0,0 +1,237 @@
+package twcCapture
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"github.com/goburrow/serial"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Capture files record the RS485 traffic one line per burst of bytes in the same direction
+//
+//	<RFC3339 timestamp with nanoseconds> <RX|TX> <hex bytes>
+//
+// e.g.
+//
+//	2019-10-23T14:02:11.123456789-04:00 RX c0fde27777...c0fe
+
+const (
+	Received = "RX"
+	Sent     = "TX"
+)
+
+// Bytes in the same direction closer together than this are written as one record
+const burstGap = 20 * time.Millisecond
+
+type Record struct {
+	Time      time.Time
+	Direction string
+	Data      []byte
+}
+
+// Records traffic to a capture file
+type Capture struct {
+	file    *os.File
+	writer  *bufio.Writer
+	pending Record
+	last    time.Time
+	closed  bool
+	mu      sync.Mutex
+}
+
+func Create(path string) (*Capture, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Capture{file: f, writer: bufio.NewWriter(f)}, nil
+}
+
+// Add bytes going in the given direction to the capture
+func (c *Capture) Record(direction string, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	now := time.Now()
+	if (c.pending.Direction != direction) || (now.Sub(c.last) > burstGap) {
+		c.flush()
+		c.pending = Record{Time: now, Direction: direction}
+	}
+	c.pending.Data = append(c.pending.Data, data...)
+	c.last = now
+}
+
+// Write out the pending record. Must be called with the lock held.
+func (c *Capture) flush() {
+	if len(c.pending.Data) == 0 {
+		return
+	}
+	_, _ = fmt.Fprintf(c.writer, "%s %s %s\n", c.pending.Time.Format(time.RFC3339Nano), c.pending.Direction, hex.EncodeToString(c.pending.Data))
+	_ = c.writer.Flush()
+	c.pending.Data = nil
+}
+
+// Write out the last burst and close the file. Anything recorded after that is dropped. Closing again does nothing.
+func (c *Capture) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.flush()
+	c.closed = true
+	return c.file.Close()
+}
+
+// Wraps a serial port recording everything read from or written to it
+type capturePort struct {
+	port    serial.Port
+	capture *Capture
+}
+
+func NewPort(p serial.Port, c *Capture) serial.Port {
+	return &capturePort{p, c}
+}
+
+func (p *capturePort) Open(c *serial.Config) error {
+	return p.port.Open(c)
+}
+
+func (p *capturePort) Read(b []byte) (int, error) {
+	n, err := p.port.Read(b)
+	p.capture.Record(Received, b[:n])
+	return n, err
+}
+
+func (p *capturePort) Write(b []byte) (int, error) {
+	n, err := p.port.Write(b)
+	p.capture.Record(Sent, b[:n])
+	return n, err
+}
+
+func (p *capturePort) Close() error {
+	err := p.port.Close()
+	_ = p.capture.Close()
+	return err
+}
+
+// Reads the records back from a capture file
+type Reader struct {
+	file    *os.File
+	scanner *bufio.Scanner
+	line    int
+}
+
+func Open(path string) (*Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{file: f, scanner: bufio.NewScanner(f)}, nil
+}
+
+// Return the next record or io.EOF at the end of the file
+func (r *Reader) Next() (Record, error) {
+	for r.scanner.Scan() {
+		r.line++
+		fields := strings.Fields(r.scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return Record{}, fmt.Errorf("capture line %d - expected 3 fields but found %d", r.line, len(fields))
+		}
+		t, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return Record{}, fmt.Errorf("capture line %d - %s", r.line, err)
+		}
+		if (fields[1] != Received) && (fields[1] != Sent) {
+			return Record{}, fmt.Errorf("capture line %d - unknown direction %s", r.line, fields[1])
+		}
+		data, err := hex.DecodeString(fields[2])
+		if err != nil {
+			return Record{}, fmt.Errorf("capture line %d - %s", r.line, err)
+		}
+		return Record{t, fields[1], data}, nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return Record{}, err
+	}
+	return Record{}, io.EOF
+}
+
+func (r *Reader) Close() error {
+	return r.file.Close()
+}
+
+// Plays the received bytes from a capture back as if they were coming from the serial port, keeping the original
+// timing. Anything written to it is thrown away. Read returns serial.ErrTimeout between bursts and io.EOF at the end.
+type replayPort struct {
+	reader  *Reader
+	start   time.Time // When we started playing
+	first   time.Time // Time of the first record in the capture
+	pending []byte
+	done    bool
+}
+
+func NewReplayPort(r *Reader) serial.Port {
+	return &replayPort{reader: r}
+}
+
+func (p *replayPort) Open(_ *serial.Config) error {
+	return nil
+}
+
+func (p *replayPort) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if len(p.pending) == 0 {
+		if p.done {
+			return 0, io.EOF
+		}
+		rec, err := p.nextReceived()
+		if err != nil {
+			p.done = true
+			return 0, err
+		}
+		if p.start.IsZero() {
+			p.start = time.Now()
+			p.first = rec.Time
+		}
+		// Wait until it is time for this burst to arrive
+		time.Sleep(time.Until(p.start.Add(rec.Time.Sub(p.first))))
+		p.pending = rec.Data
+		return 0, serial.ErrTimeout
+	}
+	n := copy(b, p.pending)
+	p.pending = p.pending[n:]
+	return n, nil
+}
+
+func (p *replayPort) nextReceived() (Record, error) {
+	for {
+		rec, err := p.reader.Next()
+		if err != nil || rec.Direction == Received {
+			return rec, err
+		}
+	}
+}
+
+func (p *replayPort) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (p *replayPort) Close() error {
+	return p.reader.Close()
+}
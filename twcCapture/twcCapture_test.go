@@ -0,0 +1,155 @@
+package twcCapture
+
+import (
+	"TeslaChargeControl/twcMessage"
+	"TeslaChargeControl/twcSlave"
+	"bytes"
+	"github.com/goburrow/serial"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Play the capture through the framer and hand each message to the slave the way the master does
+func TestReplay(t *testing.T) {
+	r, err := Open(filepath.Join("testdata", "session.cap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := NewReplayPort(r)
+	defer func() {
+		_ = port.Close()
+	}()
+
+	slave := twcSlave.New(0x1234, false, port)
+	msg := twcMessage.New(port, false)
+	discarded := twcMessage.GetDiscardedFrames()
+	var codes []int
+	invalid := 0
+	var buf [1]byte
+	for {
+		_, err := port.Read(buf[:])
+		if err == io.EOF {
+			break
+		}
+		if err == serial.ErrTimeout {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.AddByte(buf[0])
+		if !msg.IsComplete() {
+			continue
+		}
+		if !msg.IsValid() {
+			invalid++
+			msg.Reset()
+			continue
+		}
+		if msg.GetFromAddress() != slave.GetAddress() {
+			t.Errorf("message %04x from %04x", msg.GetCode(), msg.GetFromAddress())
+		}
+		codes = append(codes, msg.GetCode())
+		switch msg.GetCode() {
+		case 0xfde0:
+			slave.UpdateValues(&msg)
+		case 0xfde2:
+			slave.UpdateLinkReady(&msg)
+		case 0xfdeb:
+			slave.UpdateEnergy(&msg)
+		}
+		msg.Reset()
+	}
+
+	if want := []int{0xfde2, 0xfde0, 0xfdeb, 0xfde0}; !equal(codes, want) {
+		t.Errorf("replayed %04x, want %04x", codes, want)
+	}
+	if invalid != 1 {
+		t.Errorf("%d frames had a bad checksum, want 1", invalid)
+	}
+	if n := twcMessage.GetDiscardedFrames() - discarded; n != 1 {
+		t.Errorf("%d frames discarded, want the truncated one", n)
+	}
+	if slave.GetProtocolVersion() != twcMessage.ProtocolVersion2 {
+		t.Errorf("protocol version %d, want 2", slave.GetProtocolVersion())
+	}
+	if slave.GetMaxAmps() != 3200 {
+		t.Errorf("rating %d, want 3200", slave.GetMaxAmps())
+	}
+	if slave.GetStatusCode() != twcSlave.Status_Charging || slave.GetCurrent() != 0xc0 {
+		t.Errorf("status %d with %d, want charging with 192", slave.GetStatusCode(), slave.GetCurrent())
+	}
+	if slave.GetLifetimeEnergy() != 1234 || slave.GetPhaseVolts() != [3]int{240, 241, 239} {
+		t.Errorf("energy %dkWh at %v, want 1234kWh at [240 241 239]", slave.GetLifetimeEnergy(), slave.GetPhaseVolts())
+	}
+}
+
+func equal(a []int, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// A serial port that reads from one buffer and writes to another
+type bufferPort struct {
+	in  *bytes.Buffer
+	out *bytes.Buffer
+}
+
+func (p bufferPort) Open(*serial.Config) error   { return nil }
+func (p bufferPort) Read(b []byte) (int, error)  { return p.in.Read(b) }
+func (p bufferPort) Write(b []byte) (int, error) { return p.out.Write(b) }
+func (p bufferPort) Close() error                { return nil }
+
+// Bursts are written when the direction changes and the last one when the capture is closed
+func TestCapture(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.cap")
+	c, err := Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := NewPort(bufferPort{bytes.NewBuffer([]byte{0xc0, 0xfd, 0xe0}), &bytes.Buffer{}}, c)
+	_, _ = port.Write([]byte{0xc0, 0xfb})
+	_, _ = port.Write([]byte{0xe0})
+	var buf [3]byte
+	_, _ = port.Read(buf[:])
+	time.Sleep(2 * burstGap)
+	_, _ = port.Read(buf[:1]) // Nothing left to read so nothing is recorded
+	_, _ = port.Write([]byte{0xfe})
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("closing again failed - %s", err)
+	}
+	_, _ = port.Write([]byte{0x00}) // Dropped after the capture is closed
+
+	r, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	want := []Record{{Direction: Sent, Data: []byte{0xc0, 0xfb, 0xe0}}, {Direction: Received, Data: []byte{0xc0, 0xfd, 0xe0}}, {Direction: Sent, Data: []byte{0xfe}}}
+	for _, w := range want {
+		got, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (got.Direction != w.Direction) || !bytes.Equal(got.Data, w.Data) {
+			t.Errorf("read %s %x, want %s %x", got.Direction, got.Data, w.Direction, w.Data)
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("more records after the last - %v", err)
+	}
+}
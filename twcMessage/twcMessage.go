@@ -5,11 +5,17 @@ import (
 	"fmt"
 	"github.com/goburrow/serial"
 	"log"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
 // Message structure
 //
+// Frames are delimited by 0xc0 bytes and the payload is SLIP escaped (0xc0 -> 0xdb 0xdc, 0xdb -> 0xdb 0xdd).
+// Protocol version 1 chargers send a 13 byte payload. Protocol version 2 chargers send 15 bytes, the last two
+// carrying extra status information. The layout below is after unescaping.
+//
 // Byte	Function
 //  00	C0
 //  01	C?
@@ -25,27 +31,119 @@ import (
 //  11	Charging Current
 //  12	00
 //  13	00
-//  14	Checksum
-//  15	C0
-//  16	Fe
+//  14	(v2) 00
+//  15	(v2) 00
+//  n+1	Checksum (sum of payload bytes 02..n)
+//  n+2	C0
+//  n+3	Fe
+//
+// Slave link ready (FDE2)
+//
+// Byte	Function
+//  01	FD
+//  02	E2
+//  03	Source Address
+//  04	Source Address
+//  05	Sign
+//  06	Maximum Current Rating
+//  07	Maximum Current Rating
+//  08..n	00
+//
+// Serial number (FD19) and firmware version (FD1B) reports from a protocol version 2 slave answer the master's
+// FB19 and FB1B requests.
+//
+// Byte	Function
+//  01	FD
+//  02	19/1B
+//  03	Source Address
+//  04	Source Address
+//  05..15	Serial number characters (unused characters are 00)
+//  05..08	Firmware version major, minor, revision, extended
+//
+// Energy report (FDEB) from a protocol version 2 slave. Answers the master's FBEB request
+//
+// Byte	Function
+//  01	FD
+//  02	EB
+//  03	Source Address
+//  04	Source Address
+//  05	Lifetime Energy (kWh)
+//  06	Lifetime Energy (kWh)
+//  07	Lifetime Energy (kWh)
+//  08	Lifetime Energy (kWh)
+//  09	Phase L1 Voltage
+//  10	Phase L1 Voltage
+//  11	Phase L2 Voltage
+//  12	Phase L2 Voltage
+//  13	Phase L3 Voltage
+//  14	Phase L3 Voltage
+//  15	00
+//
+// The report does not carry per-phase currents. The current in the slave's heartbeat is drawn on every connected
+// phase so per-phase currents are derived from that and the phases that show a voltage.
+//
+// VIN reports (FDEE, FDEF and FDF1) from a protocol version 2 slave carry the first, middle and last parts of the
+// connected car's VIN. They answer the master's FBEE, FBEF and FBF1 requests.
+//
+// Byte	Function
+//  01	FD
+//  02	EE/EF/F1
+//  03	Source Address
+//  04	Source Address
+//  05..11	VIN characters (7 + 7 + 3, unused characters are 00)
+//  12..15	00
+
+// Which part of the VIN a VIN request or report is for
+const (
+	VINFirst = iota
+	VINMiddle
+	VINLast
+)
+
+// Number of VIN characters carried by each part
+var VINPartLength = [...]int{7, 7, 3}
+
+var vinRequestCodes = [...]int{0xfbee, 0xfbef, 0xfbf1}
+var vinReportCodes = [...]int{0xfdee, 0xfdef, 0xfdf1}
+
+const (
+	ProtocolVersion1 = 1
+	ProtocolVersion2 = 2
+
+	payloadLengthV1 = 13
+	payloadLengthV2 = 15
+	maxFrameLength  = payloadLengthV2 + 4 // Leading C0, checksum, trailing C0 and Fe
+)
+
+// Frames thrown away because they were the wrong length or overran the buffer
+var discardedFrames uint64
+
+// Return the number of frames thrown away before they were complete
+func GetDiscardedFrames() uint64 {
+	return atomic.LoadUint64(&discardedFrames)
+}
 
 type TwcMessage struct {
-	bytes       []byte
-	currentByte int
-	isEscaped   bool
-	port        serial.Port
-	listenMode  bool
-	isC0        bool
+	bytes         []byte
+	currentByte   int
+	isEscaped     bool
+	port          serial.Port
+	listenMode    bool
+	payloadLength int
+	complete      bool
 }
 
 func New(p serial.Port, listenMode bool) TwcMessage {
-	m := TwcMessage{make([]byte, 17), 0, false, p, listenMode, false}
+	m := TwcMessage{make([]byte, maxFrameLength), 0, false, p, listenMode, payloadLengthV1, false}
 	return m
 }
 
-// Add a new byte to the message
 // Add a new byte to the message
 func (m *TwcMessage) AddByte(b byte) {
+	// Nothing more to do until the message is reset
+	if m.complete {
+		return
+	}
 	// First byte is always 0xc0
 	if m.currentByte == 0 {
 		if b == 0xc0 {
@@ -54,66 +152,97 @@ func (m *TwcMessage) AddByte(b byte) {
 		}
 		return
 	}
-	// If the last byte was an escape character process this byte accordingly
-	if m.isEscaped {
-		if m.bytes[m.currentByte-1] == 0xdb {
-			if b == 0xdc {
-				m.bytes[m.currentByte-1] = 0xc0
-			} else if b == 0xdd {
-				m.bytes[m.currentByte-1] = 0xdb
-			}
+	// Any other 0xc0 ends the frame
+	if b == 0xc0 {
+		if m.currentByte == 1 {
+			// Back to back delimiters. Treat this one as the start of the frame.
+			return
 		}
-		m.isEscaped = false
-	} else {
-		if m.currentByte >= len(m.bytes) {
-			log.Panicf("Tried to add a byte at position %d - Length = %d - Capacity = %d\n", m.currentByte, len(m.bytes), cap(m.bytes))
+		length := m.currentByte - 2 // Everything between the delimiters less the checksum
+		if m.isEscaped || ((length != payloadLengthV1) && (length != payloadLengthV2)) {
+			log.Printf("Discarding frame with %d byte payload\n", length)
+			atomic.AddUint64(&discardedFrames, 1)
+			// This delimiter may well be the start of the next frame so keep it
+			m.Reset()
+			m.bytes[0] = b
+			m.currentByte = 1
 			return
 		}
-		m.bytes[m.currentByte] = b
-		m.currentByte++
-		if (m.currentByte >= len(m.bytes)) && !m.IsComplete() {
-			log.Print("Buffer Overflow!")
-			m.currentByte = 0
-			m.isEscaped = false
-			for i := 0; i < len(m.bytes); i++ {
-				m.bytes[i] = 0
-			}
-		} else {
-			m.isEscaped = b == 0xdb
-			if m.isC0 && (b != 0xfe) {
-				m.Reset()
-				m.bytes[0] = 0xc0
-				m.bytes[1] = b
-				m.currentByte = 2
-			}
-			m.isC0 = b == 0xc0
+		m.payloadLength = length
+		m.bytes[m.currentByte] = 0xc0
+		m.bytes[m.currentByte+1] = 0xfe
+		m.currentByte += 2
+		m.complete = true
+		return
+	}
+	// If the last byte was an escape character process this byte accordingly
+	if m.isEscaped {
+		if b == 0xdc {
+			b = 0xc0
+		} else if b == 0xdd {
+			b = 0xdb
 		}
+		m.isEscaped = false
+	} else if b == 0xdb {
+		m.isEscaped = true
+		return
 	}
+	if m.currentByte > payloadLengthV2+1 {
+		log.Print("Buffer Overflow!")
+		atomic.AddUint64(&discardedFrames, 1)
+		m.Reset()
+		return
+	}
+	m.bytes[m.currentByte] = b
+	m.currentByte++
 }
 
 func (m *TwcMessage) IsComplete() bool {
-	return (m.bytes[16] == 0xfe) && (m.currentByte == cap(m.bytes))
+	return m.complete
 }
 
 func (m *TwcMessage) IsValid() (valid bool) {
-	chksum := m.bytes[2]
-	for _, b := range m.bytes[3:13] {
+	return m.checksum() == m.bytes[m.payloadLength+1]
+}
+
+// Sum of the payload bytes following the first one
+func (m *TwcMessage) checksum() byte {
+	var chksum byte
+	for _, b := range m.bytes[2 : m.payloadLength+1] {
 		chksum += b
 	}
-	return (chksum & 0xff) == m.bytes[14]
+	return chksum
 }
 
+// Clear out the message ready to receive the next one. The protocol version is left alone.
 func (m *TwcMessage) Reset() {
 	m.isEscaped = false
-	m.isC0 = false
+	m.complete = false
 	m.currentByte = 0
-	for i := 0; i < cap(m.bytes); i++ {
+	for i := 0; i < len(m.bytes); i++ {
 		m.bytes[i] = 0
 	}
 }
 
+// Return the protocol version of the charger that sent this message based on the length of the payload
+func (m *TwcMessage) GetProtocolVersion() int {
+	if m.payloadLength == payloadLengthV2 {
+		return ProtocolVersion2
+	}
+	return ProtocolVersion1
+}
+
+// Set the protocol version used to lay out messages we send
+func (m *TwcMessage) SetProtocolVersion(v int) {
+	if v == ProtocolVersion2 {
+		m.payloadLength = payloadLengthV2
+	} else {
+		m.payloadLength = payloadLengthV1
+	}
+}
+
 func (m *TwcMessage) Print() {
-	fmt.Println(hex.EncodeToString(m.bytes))
+	fmt.Println(hex.EncodeToString(m.bytes[:m.payloadLength+4]))
 }
 
 func (m *TwcMessage) GetCode() int {
@@ -169,6 +298,88 @@ func (m *TwcMessage) PutCurrent(i int) {
 	m.bytes[11] = byte(i & 0xff)
 }
 
+func (m *TwcMessage) GetLifetimeEnergy() int {
+	return (int(m.bytes[5]) << 24) + (int(m.bytes[6]) << 16) + (int(m.bytes[7]) << 8) + int(m.bytes[8])
+}
+
+func (m *TwcMessage) PutLifetimeEnergy(i int) {
+	m.bytes[5] = byte((i >> 24) & 0xff)
+	m.bytes[6] = byte((i >> 16) & 0xff)
+	m.bytes[7] = byte((i >> 8) & 0xff)
+	m.bytes[8] = byte(i & 0xff)
+}
+
+// Voltage reported for the given phase (0..2) in an energy report
+func (m *TwcMessage) GetPhaseVoltage(phase int) int {
+	if (phase < 0) || (phase > 2) {
+		return 0
+	}
+	return (int(m.bytes[9+(phase*2)]) << 8) + int(m.bytes[10+(phase*2)])
+}
+
+func (m *TwcMessage) PutPhaseVoltage(phase int, volts int) {
+	if (phase < 0) || (phase > 2) {
+		return
+	}
+	m.bytes[9+(phase*2)] = byte((volts >> 8) & 0xff)
+	m.bytes[10+(phase*2)] = byte(volts & 0xff)
+}
+
+// Maximum current rating (Amps x 100) from a slave link ready message
+func (m *TwcMessage) GetMaxAmps() int {
+	return (int(m.bytes[6]) << 8) + int(m.bytes[7])
+}
+
+func (m *TwcMessage) PutMaxAmps(i int) {
+	m.bytes[6] = byte((i >> 8) & 0xff)
+	m.bytes[7] = byte(i & 0xff)
+}
+
+func (m *TwcMessage) GetSerialNumber() string {
+	return strings.TrimRight(string(m.bytes[5:m.payloadLength+1]), "\x00")
+}
+
+func (m *TwcMessage) PutSerialNumber(serial string) {
+	copy(m.bytes[5:m.payloadLength+1], serial)
+}
+
+func (m *TwcMessage) GetFirmwareVersion() string {
+	return fmt.Sprintf("%d.%d.%d.%d", m.bytes[5], m.bytes[6], m.bytes[7], m.bytes[8])
+}
+
+func (m *TwcMessage) PutFirmwareVersion(version [4]byte) {
+	copy(m.bytes[5:9], version[:])
+}
+
+// Return which part of the VIN this message reports or -1 if it is not a VIN report
+func (m *TwcMessage) GetVINPart() int {
+	for part, code := range vinReportCodes {
+		if m.GetCode() == code {
+			return part
+		}
+	}
+	return -1
+}
+
+// Return the VIN characters carried by a VIN report
+func (m *TwcMessage) GetVINFragment() string {
+	part := m.GetVINPart()
+	if part < 0 {
+		return ""
+	}
+	return string(m.bytes[5 : 5+VINPartLength[part]])
+}
+
+// Return which part of the VIN this message asks for or -1 if it is not a VIN request
+func (m *TwcMessage) GetVINRequestPart() int {
+	for part, code := range vinRequestCodes {
+		if m.GetCode() == code {
+			return part
+		}
+	}
+	return -1
+}
+
 func (m *TwcMessage) writeByte(b byte) {
 	if !m.listenMode {
 		bytes := make([]byte, 0)
@@ -180,19 +391,18 @@ func (m *TwcMessage) writeByte(b byte) {
 }
 
 func (m *TwcMessage) SendMessage() {
-	//Calculate a new checksum
-	chksum := m.bytes[2]
-	for _, b := range m.bytes[3:13] {
-		chksum += b
-	}
-	m.bytes[14] = chksum & 0xff
+	//Frame the payload and calculate a new checksum
+	m.bytes[0] = 0xc0
+	m.bytes[m.payloadLength+1] = m.checksum()
+	m.bytes[m.payloadLength+2] = 0xc0
+	m.bytes[m.payloadLength+3] = 0xfe
 
 	if m.listenMode {
 		fmt.Print("Sending : ")
 	}
-	for idx, b := range m.bytes {
-		//Escape 0xc0 and 0xdb codes if in the data area of the message (bytes 1..14)
-		if idx == 0 || idx > 14 {
+	for idx, b := range m.bytes[:m.payloadLength+4] {
+		//Escape 0xc0 and 0xdb codes if in the data area of the message (payload and checksum)
+		if idx == 0 || idx > m.payloadLength+1 {
 			m.writeByte(b)
 		} else {
 			switch b {
@@ -213,8 +423,14 @@ func (m *TwcMessage) SendMessage() {
 	time.Sleep(100 * time.Millisecond)
 }
 
+// Clear the message and put in the code ready to fill in the rest of the payload for sending
+func (m *TwcMessage) prepare(code int) {
+	m.Reset()
+	m.PutCode(code)
+}
+
 func (m *TwcMessage) SendMasterLinkReady1(fromAddress uint) {
-	copy(m.bytes, []byte{0xc0, 0xfc, 0xe1, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xfc, 0xfe})
+	m.prepare(0xfce1)
 	m.PutFromAddress(fromAddress)
 	m.PutToAddress(fromAddress)
 	if m.listenMode {
@@ -224,7 +440,7 @@ func (m *TwcMessage) SendMasterLinkReady1(fromAddress uint) {
 }
 
 func (m *TwcMessage) SendMasterLinkReady2(fromAddress uint) {
-	copy(m.bytes, []byte{0xc0, 0xfb, 0xe2, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xfc, 0xfe})
+	m.prepare(0xfbe2)
 	m.PutFromAddress(fromAddress)
 	m.PutToAddress(fromAddress)
 	if m.listenMode {
@@ -234,7 +450,7 @@ func (m *TwcMessage) SendMasterLinkReady2(fromAddress uint) {
 }
 
 func (m *TwcMessage) SendMasterHeartbeat(fromAddress uint, toAddress uint, status byte, current int, setPoint int) {
-	copy(m.bytes, []byte{0xc0, 0xfb, 0xe0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xc0, 0xfe})
+	m.prepare(0xfbe0)
 	m.PutFromAddress(fromAddress)
 	m.PutToAddress(toAddress)
 	m.PutStatus(status)
@@ -245,3 +461,122 @@ func (m *TwcMessage) SendMasterHeartbeat(fromAddress uint, toAddress uint, statu
 	}
 	m.SendMessage()
 }
+
+// Ask a slave for its lifetime energy and phase voltages. The slave answers with an FDEB message.
+func (m *TwcMessage) SendEnergyRequest(fromAddress uint, toAddress uint) {
+	m.prepare(0xfbeb)
+	m.PutFromAddress(fromAddress)
+	m.PutToAddress(toAddress)
+	if m.listenMode {
+		fmt.Print("Energy Request ")
+	}
+	m.SendMessage()
+}
+
+// Ask a slave for part of the VIN of the car plugged into it. The slave answers with an FDEE, FDEF or FDF1 message.
+func (m *TwcMessage) SendVINRequest(fromAddress uint, toAddress uint, part int) {
+	m.prepare(vinRequestCodes[part])
+	m.PutFromAddress(fromAddress)
+	m.PutToAddress(toAddress)
+	if m.listenMode {
+		fmt.Printf("VIN Request %d ", part)
+	}
+	m.SendMessage()
+}
+
+// Ask a slave for its serial number. The slave answers with an FD19 message.
+func (m *TwcMessage) SendSerialNumberRequest(fromAddress uint, toAddress uint) {
+	m.prepare(0xfb19)
+	m.PutFromAddress(fromAddress)
+	m.PutToAddress(toAddress)
+	if m.listenMode {
+		fmt.Print("Serial Number Request ")
+	}
+	m.SendMessage()
+}
+
+// Ask a slave for its firmware version. The slave answers with an FD1B message.
+func (m *TwcMessage) SendFirmwareVersionRequest(fromAddress uint, toAddress uint) {
+	m.prepare(0xfb1b)
+	m.PutFromAddress(fromAddress)
+	m.PutToAddress(toAddress)
+	if m.listenMode {
+		fmt.Print("Firmware Version Request ")
+	}
+	m.SendMessage()
+}
+
+// The messages below are sent by slaves. They are used to simulate Wall Connectors.
+
+func (m *TwcMessage) SendSlaveLinkReady(fromAddress uint, maxAmps int) {
+	m.prepare(0xfde2)
+	m.PutFromAddress(fromAddress)
+	m.PutMaxAmps(maxAmps)
+	if m.listenMode {
+		fmt.Print("Slave Link Ready ")
+	}
+	m.SendMessage()
+}
+
+func (m *TwcMessage) SendSlaveHeartbeat(fromAddress uint, toAddress uint, status byte, setPoint int, current int) {
+	m.prepare(0xfde0)
+	m.PutFromAddress(fromAddress)
+	m.PutToAddress(toAddress)
+	m.PutStatus(status)
+	m.PutSetPoint(setPoint)
+	m.PutCurrent(current)
+	if m.listenMode {
+		fmt.Print("Slave Heartbeat ")
+	}
+	m.SendMessage()
+}
+
+func (m *TwcMessage) SendEnergyReport(fromAddress uint, lifetimeEnergy int, volts [3]int) {
+	m.prepare(0xfdeb)
+	m.PutFromAddress(fromAddress)
+	m.PutLifetimeEnergy(lifetimeEnergy)
+	for phase, v := range volts {
+		m.PutPhaseVoltage(phase, v)
+	}
+	if m.listenMode {
+		fmt.Print("Energy Report ")
+	}
+	m.SendMessage()
+}
+
+func (m *TwcMessage) SendSerialNumber(fromAddress uint, serialNumber string) {
+	m.prepare(0xfd19)
+	m.PutFromAddress(fromAddress)
+	m.PutSerialNumber(serialNumber)
+	if m.listenMode {
+		fmt.Print("Serial Number ")
+	}
+	m.SendMessage()
+}
+
+func (m *TwcMessage) SendFirmwareVersion(fromAddress uint, version [4]byte) {
+	m.prepare(0xfd1b)
+	m.PutFromAddress(fromAddress)
+	m.PutFirmwareVersion(version)
+	if m.listenMode {
+		fmt.Print("Firmware Version ")
+	}
+	m.SendMessage()
+}
+
+// Send the given part of a VIN
+func (m *TwcMessage) SendVINReport(fromAddress uint, part int, vin string) {
+	m.prepare(vinReportCodes[part])
+	m.PutFromAddress(fromAddress)
+	start := 0
+	for p := 0; p < part; p++ {
+		start += VINPartLength[p]
+	}
+	if start < len(vin) {
+		copy(m.bytes[5:5+VINPartLength[part]], vin[start:])
+	}
+	if m.listenMode {
+		fmt.Printf("VIN Report %d ", part)
+	}
+	m.SendMessage()
+}
@@ -0,0 +1,133 @@
+package twcMessage
+
+import (
+	"bytes"
+	"github.com/goburrow/serial"
+	"testing"
+)
+
+// Build the bytes a charger would send for a payload. payload starts at the code and does not include the checksum.
+// badChecksum is added to the correct checksum.
+func frame(payload []byte, badChecksum byte) []byte {
+	var sum byte
+	for _, b := range payload[1:] {
+		sum += b
+	}
+	out := []byte{0xc0}
+	for _, b := range append(append([]byte{}, payload...), sum+badChecksum) {
+		switch b {
+		case 0xc0:
+			out = append(out, 0xdb, 0xdc)
+		case 0xdb:
+			out = append(out, 0xdb, 0xdd)
+		default:
+			out = append(out, b)
+		}
+	}
+	return append(out, 0xc0, 0xfe)
+}
+
+// A slave heartbeat from 1234 to 7777 with the given current. v2 adds the two extra status bytes.
+func heartbeat(v2 bool, current int) []byte {
+	p := []byte{0xfd, 0xe0, 0x12, 0x34, 0x77, 0x77, 0x01, 0x0c, 0x80, byte(current >> 8), byte(current), 0x00, 0x00}
+	if v2 {
+		p = append(p, 0x00, 0x00)
+	}
+	return p
+}
+
+type received struct {
+	valid    bool
+	protocol int
+	code     int
+	from     uint
+	current  int
+}
+
+// Feed the bytes to a message the way the main loop does and return every frame that completes
+func feed(in []byte) []received {
+	m := New(nil, false)
+	var out []received
+	for _, b := range in {
+		m.AddByte(b)
+		if m.IsComplete() {
+			out = append(out, received{m.IsValid(), m.GetProtocolVersion(), m.GetCode(), m.GetFromAddress(), m.GetCurrent()})
+			m.Reset()
+		}
+	}
+	return out
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestAddByte(t *testing.T) {
+	good1 := received{true, ProtocolVersion1, 0xfde0, 0x1234, 0x0640}
+	good2 := received{true, ProtocolVersion2, 0xfde0, 0x1234, 0x0640}
+	tests := []struct {
+		name      string
+		in        []byte
+		want      []received
+		discarded uint64
+	}{
+		{"protocol 1", frame(heartbeat(false, 0x0640), 0), []received{good1}, 0},
+		{"protocol 2", frame(heartbeat(true, 0x0640), 0), []received{good2}, 0},
+		{"escaped C0 and DB", frame(heartbeat(true, 0xc0db), 0), []received{{true, ProtocolVersion2, 0xfde0, 0x1234, 0xc0db}}, 0},
+		{"escaped checksum", frame([]byte{0xfd, 0xe0, 0x00, 0xc0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, 0), []received{{true, ProtocolVersion1, 0xfde0, 0x00c0, 0}}, 0},
+		{"noise before the frame", join([]byte{0x12, 0xfe, 0x00}, frame(heartbeat(false, 0x0640), 0)), []received{good1}, 0},
+		{"back to back delimiters", join([]byte{0xc0}, frame(heartbeat(false, 0x0640), 0)), []received{good1}, 0},
+		{"two frames", join(frame(heartbeat(false, 0x0640), 0), frame(heartbeat(true, 0x0640), 0)), []received{good1, good2}, 0},
+		{"truncated frame then a good one", join([]byte{0xc0, 0xfd, 0xe0, 0x12}, frame(heartbeat(true, 0x0640), 0)), []received{good2}, 1},
+		{"frame ending in an escape", join([]byte{0xc0, 0xfd, 0xe0, 0x12, 0x34, 0x77, 0x77, 0x01, 0x0c, 0x80, 0x06, 0x40, 0x00, 0x00, 0xdb}, frame(heartbeat(false, 0x0640), 0)), []received{good1}, 1},
+		{"overflow then a good frame", join([]byte{0xc0}, bytes.Repeat([]byte{0x11}, 20), frame(heartbeat(false, 0x0640), 0)), []received{good1}, 1},
+		{"bad checksum", frame(heartbeat(false, 0x0640), 1), []received{{false, ProtocolVersion1, 0xfde0, 0x1234, 0x0640}}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			before := GetDiscardedFrames()
+			got := feed(test.in)
+			if len(got) != len(test.want) {
+				t.Fatalf("got %d frames %+v, want %d %+v", len(got), got, len(test.want), test.want)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Errorf("frame %d is %+v, want %+v", i, got[i], test.want[i])
+				}
+			}
+			if discarded := GetDiscardedFrames() - before; discarded != test.discarded {
+				t.Errorf("%d frames discarded, want %d", discarded, test.discarded)
+			}
+		})
+	}
+}
+
+// Frames we send must come back through the receiver unchanged
+func TestSendMessageRoundTrip(t *testing.T) {
+	for _, version := range []int{ProtocolVersion1, ProtocolVersion2} {
+		var port bytes.Buffer
+		m := New(nil, false)
+		m.port = writerPort{&port}
+		m.SetProtocolVersion(version)
+		m.prepare(0xfbe0)
+		m.PutFromAddress(0x7777)
+		m.PutToAddress(0x1234)
+		m.PutStatus(0x05)
+		m.PutSetPoint(0xc0db)
+		m.SendMessage()
+
+		got := feed(port.Bytes())
+		want := received{true, version, 0xfbe0, 0x7777, 0}
+		if (len(got) != 1) || (got[0] != want) {
+			t.Errorf("protocol %d sent %x and got back %+v, want %+v", version, port.Bytes(), got, want)
+		}
+	}
+}
+
+// A serial port that writes into a buffer
+type writerPort struct {
+	*bytes.Buffer
+}
+
+func (writerPort) Open(*serial.Config) error { return nil }
+func (writerPort) Close() error              { return nil }
@@ -0,0 +1,61 @@
+//go:build linux
+
+package twcSimulator
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+func ioctl(fd uintptr, request uintptr, arg uintptr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, arg)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Open a pseudo terminal pair. The master side is ours; the controller opens the slave side by name as if it
+// were the RS485 adapter. The slave is put into raw mode so nothing we write gets echoed back before the
+// controller opens it.
+func openPty() (master *os.File, slave *os.File, err error) {
+	// Open it non blocking so the runtime poller can interrupt a read when we close it
+	fd, err := syscall.Open("/dev/ptmx", syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	master = os.NewFile(uintptr(fd), "/dev/ptmx")
+	var n uint32
+	var unlock int32
+	if err = ioctl(uintptr(fd), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); err == nil {
+		err = ioctl(uintptr(fd), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock)))
+	}
+	if err != nil {
+		_ = master.Close()
+		return nil, nil, err
+	}
+	slave, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		_ = master.Close()
+		return nil, nil, err
+	}
+	var t syscall.Termios
+	if err = ioctl(slave.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&t))); err == nil {
+		t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+		t.Oflag &^= syscall.OPOST
+		t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+		t.Cflag &^= syscall.CSIZE | syscall.PARENB
+		t.Cflag |= syscall.CS8
+		t.Cc[syscall.VMIN] = 1
+		t.Cc[syscall.VTIME] = 0
+		err = ioctl(slave.Fd(), syscall.TCSETS, uintptr(unsafe.Pointer(&t)))
+	}
+	if err != nil {
+		_ = slave.Close()
+		_ = master.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package twcSimulator
+
+import (
+	"errors"
+	"os"
+)
+
+func openPty() (master *os.File, slave *os.File, err error) {
+	return nil, nil, errors.New("the TWC simulator needs Linux pseudo terminals")
+}
@@ -0,0 +1,304 @@
+package twcSimulator
+
+import (
+	"TeslaChargeControl/twcMessage"
+	"TeslaChargeControl/twcSlave"
+	"github.com/goburrow/serial"
+	"os"
+	"sync"
+	"time"
+)
+
+// Simulates one or more Tesla Wall Connectors on the far side of a pseudo terminal so the controller can be run
+// without an RS485 adapter. Point the controller's serial port address at GetPortName().
+//
+// Each simulated charger sends link ready messages until the master sends it a heartbeat, then answers every
+// heartbeat with its own. A car plugged in waits at Ready To Charge until it is allowed at least 5A, spends
+// StartDelay at Starting To Charge and then ramps its current towards the allowed value at RampRate.
+
+const (
+	StartDelay     = 5 * time.Second // Time a car spends starting to charge before drawing current
+	RampRate       = 200             // Amps x 100 per second the car current moves towards the allowed current
+	tickInterval   = time.Second
+	minAmps        = 500
+	defaultVoltage = 240
+)
+
+type Charger struct {
+	address         uint
+	protocol        int
+	maxAmps         int // Rating sent in the link ready message (Amps x 100)
+	serialNumber    string
+	firmwareVersion [4]byte
+	linked          bool // True once the master has sent us a heartbeat
+	status          byte
+	allowed         int // Current the master allows (Amps x 100)
+	current         int // Current the car is drawing (Amps x 100)
+	pluggedIn       bool
+	vin             string
+	carMaxAmps      int // Most current the car will take (Amps x 100)
+	startedAt       time.Time
+	energy          float64 // Lifetime energy in kWh
+	mu              sync.Mutex
+}
+
+func NewCharger(address uint, protocol int, maxAmps int, serialNumber string) *Charger {
+	c := new(Charger)
+	c.address = address
+	c.protocol = protocol
+	c.maxAmps = maxAmps
+	c.serialNumber = serialNumber
+	c.firmwareVersion = [4]byte{4, 5, 3, 0}
+	c.status = twcSlave.Status_Ready
+	return c
+}
+
+// Plug a car in. carMaxAmps (Amps x 100) is the most current it will draw.
+func (c *Charger) PlugIn(vin string, carMaxAmps int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pluggedIn = true
+	c.vin = vin
+	c.carMaxAmps = carMaxAmps
+	c.status = twcSlave.Status_ReadyToCharge
+}
+
+func (c *Charger) Unplug() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pluggedIn = false
+	c.vin = ""
+	c.current = 0
+	c.status = twcSlave.Status_Ready
+}
+
+func (c *Charger) GetAddress() uint {
+	return c.address
+}
+
+func (c *Charger) GetStatus() byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.status
+}
+
+func (c *Charger) GetAllowed() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.allowed
+}
+
+func (c *Charger) GetCurrent() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.current
+}
+
+func (c *Charger) IsLinked() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.linked
+}
+
+// Move the car along by one tick
+func (c *Charger) update(elapsed time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	target := 0
+	switch {
+	case !c.pluggedIn:
+		c.status = twcSlave.Status_Ready
+	case c.allowed < minAmps:
+		c.status = twcSlave.Status_ReadyToCharge
+	case (c.status != twcSlave.Status_StartingToCharge) && (c.status != twcSlave.Status_Charging):
+		c.status = twcSlave.Status_StartingToCharge
+		c.startedAt = time.Now()
+	case time.Since(c.startedAt) >= StartDelay:
+		c.status = twcSlave.Status_Charging
+		target = c.allowed
+		if target > c.carMaxAmps {
+			target = c.carMaxAmps
+		}
+	}
+	step := int(RampRate * elapsed.Seconds())
+	if c.current < target {
+		c.current += step
+		if c.current > target {
+			c.current = target
+		}
+	} else if c.current > target {
+		c.current -= step
+		if c.current < target {
+			c.current = target
+		}
+	}
+	c.energy += float64(c.current) / 100 * defaultVoltage * elapsed.Hours() / 1000
+}
+
+// Wraps the master side of the pseudo terminal so twcMessage can send through it
+type ptyPort struct {
+	file *os.File
+}
+
+func (p *ptyPort) Open(_ *serial.Config) error {
+	return nil
+}
+
+func (p *ptyPort) Read(b []byte) (int, error) {
+	return p.file.Read(b)
+}
+
+func (p *ptyPort) Write(b []byte) (int, error) {
+	return p.file.Write(b)
+}
+
+func (p *ptyPort) Close() error {
+	return p.file.Close()
+}
+
+type Simulator struct {
+	master   *os.File
+	slave    *os.File
+	port     serial.Port
+	chargers []*Charger
+	done     chan struct{}
+	sending  sync.Mutex // One message on the wire at a time
+	wg       sync.WaitGroup
+}
+
+// Open a pseudo terminal and start simulating the given chargers on it
+func New(chargers ...*Charger) (*Simulator, error) {
+	master, slave, err := openPty()
+	if err != nil {
+		return nil, err
+	}
+	s := &Simulator{master: master, slave: slave, port: &ptyPort{master}, chargers: chargers, done: make(chan struct{})}
+	s.wg.Add(2)
+	go s.receive()
+	go s.tick()
+	return s, nil
+}
+
+// Name of the device the controller should open as its serial port
+func (s *Simulator) GetPortName() string {
+	return s.slave.Name()
+}
+
+func (s *Simulator) GetChargers() []*Charger {
+	return s.chargers
+}
+
+func (s *Simulator) Close() error {
+	close(s.done)
+	// Closing the slave side makes the blocked read on the master side return
+	_ = s.slave.Close()
+	err := s.master.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Simulator) findCharger(address uint) *Charger {
+	for _, c := range s.chargers {
+		if c.address == address {
+			return c
+		}
+	}
+	return nil
+}
+
+// Decode what the master sends and answer it
+func (s *Simulator) receive() {
+	defer s.wg.Done()
+	var buf [64]byte
+	msg := twcMessage.New(s.port, false)
+	for {
+		n, err := s.master.Read(buf[:])
+		if err != nil {
+			return
+		}
+		for _, b := range buf[:n] {
+			msg.AddByte(b)
+			if msg.IsComplete() {
+				if msg.IsValid() {
+					s.answer(&msg)
+				}
+				msg.Reset()
+			}
+		}
+	}
+}
+
+func (s *Simulator) answer(msg *twcMessage.TwcMessage) {
+	c := s.findCharger(msg.GetToAddress())
+	if c == nil {
+		return
+	}
+	master := msg.GetFromAddress()
+	reply := twcMessage.New(s.port, false)
+	reply.SetProtocolVersion(c.protocol)
+
+	c.mu.Lock()
+	switch msg.GetCode() {
+	case 0xfbe0:
+		c.linked = true
+		switch msg.GetStatus() {
+		case twcSlave.MasterChangeSetpoint, twcSlave.MasterLimitChargeCurrent:
+			c.allowed = msg.GetSetPoint()
+			if c.allowed > c.maxAmps {
+				c.allowed = c.maxAmps
+			}
+		}
+		status, allowed, current := c.status, c.allowed, c.current
+		c.mu.Unlock()
+		s.send(func() { reply.SendSlaveHeartbeat(c.address, master, status, allowed, current) })
+		return
+	}
+	c.mu.Unlock()
+
+	// Everything else is only answered by protocol 2 chargers
+	if c.protocol != twcMessage.ProtocolVersion2 {
+		return
+	}
+	c.mu.Lock()
+	energy, vin := int(c.energy), c.vin
+	c.mu.Unlock()
+	switch msg.GetCode() {
+	case 0xfbeb:
+		s.send(func() { reply.SendEnergyReport(c.address, energy, [3]int{defaultVoltage, 0, 0}) })
+	case 0xfb19:
+		s.send(func() { reply.SendSerialNumber(c.address, c.serialNumber) })
+	case 0xfb1b:
+		s.send(func() { reply.SendFirmwareVersion(c.address, c.firmwareVersion) })
+	case 0xfbee, 0xfbef, 0xfbf1:
+		part := msg.GetVINRequestPart()
+		s.send(func() { reply.SendVINReport(c.address, part, vin) })
+	}
+}
+
+func (s *Simulator) send(f func()) {
+	s.sending.Lock()
+	defer s.sending.Unlock()
+	f()
+}
+
+// Move the cars along and send link ready messages from chargers the master has not picked up yet
+func (s *Simulator) tick() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			for _, c := range s.chargers {
+				c.update(tickInterval)
+				if !c.IsLinked() {
+					msg := twcMessage.New(s.port, false)
+					msg.SetProtocolVersion(c.protocol)
+					s.send(func() { msg.SendSlaveLinkReady(c.address, c.maxAmps) })
+				}
+			}
+		}
+	}
+}
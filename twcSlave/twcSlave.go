@@ -4,6 +4,7 @@ import (
 	"TeslaChargeControl/twcMessage"
 	"github.com/goburrow/serial"
 	"log"
+	"strings"
 	"time"
 )
 
@@ -48,8 +49,38 @@ type Slave struct {
 	port          serial.Port
 	spikeTime     time.Time
 	spikeAmps     int
+	protocol      int // TWC protocol version. Version 2 chargers send and expect the longer message layout
+	// Meter readings from the slave's energy reports
+	lifetimeEnergy    int    // kWh
+	phaseVolts        [3]int // Volts for L1, L2 and L3. 0 if the phase is not connected
+	lastEnergyReport  time.Time
+	lastEnergyRequest time.Time
+	// VIN of the connected car, collected in three parts after it starts charging
+	vinParts       [3]string
+	vinWanted      bool
+	lastVINRequest time.Time
+	// Identity reported by the slave during link up
+	maxAmps             int // Current rating (Amps x 100) from the link ready message. 0 if not known
+	serialNumber        string
+	firmwareVersion     string
+	lastIdentityRequest time.Time
+	// Limits configured for this charger (Amps x 100). 0 if not configured
+	configMaxAmps int
+	configMinAmps int
 }
 
+// Cars won't charge on less than 5 amps
+const DefaultMinAmps = 500
+
+// Minimum time between VIN requests to a slave
+const VINRequestInterval = 2 * time.Second
+
+// Minimum time between serial number or firmware version requests to a slave
+const IdentityRequestInterval = 2 * time.Second
+
+// How often the master asks protocol 2 slaves for their meter readings
+const EnergyRequestInterval = time.Minute
+
 const (
 	MasterStatusQuo = iota
 	_
@@ -76,7 +107,7 @@ const (
 )
 
 func New(address uint, listenMode bool, port serial.Port) Slave {
-	s := Slave{address, 0.0, 0.0, 0.0, 0, time.Now(), listenMode, port, time.Now(), 0}
+	s := Slave{address: address, lastHeartBeat: time.Now(), listenMode: listenMode, port: port, spikeTime: time.Now(), protocol: twcMessage.ProtocolVersion1}
 	_, _, _, _, _ = MasterError, MasterTempIncrease2Amps, MasterTempDecrease2Amps, MasterAckCarStopped, MasterLimitChargeCurrent
 	_, _, _, _, _, _, _ = SlaveReady, SlaveCharging, SlaveLostComms, SlaveDoNotCharge, SlaveReadyToCharge, SlaveBusy, SlaveStartingToCharge
 	return s
@@ -91,6 +122,15 @@ func (s *Slave) GetAddress() uint {
 	return s.address
 }
 
+func (s *Slave) GetProtocolVersion() int {
+	return s.protocol
+}
+
+// Return the raw status code reported by the slave
+func (s *Slave) GetStatusCode() byte {
+	return s.status
+}
+
 func (s *Slave) GetStatus() string {
 	switch s.status {
 	case Status_Ready:
@@ -111,15 +151,62 @@ func (s *Slave) GetStatus() string {
 	return "Unknown Status"
 }
 
-// Set the allowed current for this slave.
+// Set the allowed current for this slave. Never allow more than the slave's limit and stop it altogether if we
+// can't give it its minimum.
 func (s *Slave) SetCurrent(newValue int) {
+	limit := s.GetCurrentLimit()
+	if (limit > 0) && (newValue > limit) {
+		newValue = limit
+	}
+	if newValue < s.GetMinimumCurrent() {
+		newValue = 0
+	}
 	if (s.allowedValue < newValue) && (s.allowedValue < 1600) && (newValue < 1600) {
 		s.spikeAmps = 1600
+		if (limit > 0) && (s.spikeAmps > limit) {
+			s.spikeAmps = limit
+		}
 		s.spikeTime = time.Now().Add(time.Second * 6)
 	}
 	s.allowedValue = newValue
 }
 
+// Set the configured limits for this charger (Amps x 100). 0 leaves the default in place.
+func (s *Slave) SetLimits(minAmps int, maxAmps int) {
+	s.configMinAmps = minAmps
+	s.configMaxAmps = maxAmps
+}
+
+// The most current this slave may be given (Amps x 100). This is the lower of its rating and the configured maximum,
+// or 0 if neither is known.
+func (s *Slave) GetCurrentLimit() int {
+	if (s.configMaxAmps > 0) && ((s.maxAmps == 0) || (s.configMaxAmps < s.maxAmps)) {
+		return s.configMaxAmps
+	}
+	return s.maxAmps
+}
+
+// The least current worth giving this slave (Amps x 100)
+func (s *Slave) GetMinimumCurrent() int {
+	if s.configMinAmps > 0 {
+		return s.configMinAmps
+	}
+	return DefaultMinAmps
+}
+
+// Current rating of the slave (Amps x 100) or 0 if it has not told us
+func (s *Slave) GetMaxAmps() int {
+	return s.maxAmps
+}
+
+func (s *Slave) GetSerialNumber() string {
+	return s.serialNumber
+}
+
+func (s *Slave) GetFirmwareVersion() string {
+	return s.firmwareVersion
+}
+
 func (s *Slave) GetCurrent() int {
 	return s.current
 }
@@ -132,13 +219,159 @@ func (s *Slave) GetAllowed() int {
 	return s.allowedValue
 }
 
+// True if the status shows a car is charging or about to
+func isCharging(status byte) bool {
+	return (status == Status_Charging) || (status == Status_StartingToCharge)
+}
+
 func (s *Slave) UpdateValues(msg *twcMessage.TwcMessage) {
+	// When a car starts charging forget the last VIN and ask for the new one
+	if isCharging(msg.GetStatus()) && !isCharging(s.status) {
+		s.vinParts = [3]string{}
+		s.vinWanted = true
+	}
 	s.setPoint = msg.GetSetPoint()
 	s.current = msg.GetCurrent()
 	s.status = msg.GetStatus()
+	s.protocol = msg.GetProtocolVersion()
+	s.lastHeartBeat = time.Now()
+}
+
+// Record the current a master heartbeat allows this slave. Used when following another master. The master only keeps
+// talking to slaves that answer so its heartbeats count as hearing from the slave.
+func (s *Slave) UpdateFromMaster(msg *twcMessage.TwcMessage) {
+	switch msg.GetStatus() {
+	case MasterChangeSetpoint, MasterLimitChargeCurrent:
+		s.allowedValue = msg.GetSetPoint()
+	}
+	s.lastHeartBeat = time.Now()
+}
+
+// Record the protocol version and current rating from a slave link ready message
+func (s *Slave) UpdateLinkReady(msg *twcMessage.TwcMessage) {
+	s.protocol = msg.GetProtocolVersion()
+	s.maxAmps = msg.GetMaxAmps()
+	s.lastHeartBeat = time.Now()
+}
+
+func (s *Slave) UpdateSerialNumber(msg *twcMessage.TwcMessage) {
+	s.serialNumber = msg.GetSerialNumber()
+	s.lastHeartBeat = time.Now()
+}
+
+func (s *Slave) UpdateFirmwareVersion(msg *twcMessage.TwcMessage) {
+	s.firmwareVersion = msg.GetFirmwareVersion()
 	s.lastHeartBeat = time.Now()
 }
 
+// Ask the slave for its serial number then its firmware version until we have both. Only protocol 2 slaves know
+// how to answer.
+func (s *Slave) RequestIdentity(masterAddress uint) {
+	if (s.protocol != twcMessage.ProtocolVersion2) || (time.Since(s.lastIdentityRequest) < IdentityRequestInterval) {
+		return
+	}
+	msg := twcMessage.New(s.port, s.listenMode)
+	msg.SetProtocolVersion(s.protocol)
+	if s.serialNumber == "" {
+		msg.SendSerialNumberRequest(masterAddress, s.address)
+	} else if s.firmwareVersion == "" {
+		msg.SendFirmwareVersionRequest(masterAddress, s.address)
+	} else {
+		return
+	}
+	s.lastIdentityRequest = time.Now()
+}
+
+// Record the lifetime energy and phase voltages from an FDEB energy report
+func (s *Slave) UpdateEnergy(msg *twcMessage.TwcMessage) {
+	s.lifetimeEnergy = msg.GetLifetimeEnergy()
+	for phase := range s.phaseVolts {
+		s.phaseVolts[phase] = msg.GetPhaseVoltage(phase)
+	}
+	s.lastEnergyReport = time.Now()
+	s.lastHeartBeat = time.Now()
+}
+
+func (s *Slave) GetLifetimeEnergy() int {
+	return s.lifetimeEnergy
+}
+
+func (s *Slave) GetPhaseVolts() [3]int {
+	return s.phaseVolts
+}
+
+// Return the current on L1, L2 and L3 in Amps x 100. The energy report has no currents so this is the heartbeat
+// current on each phase that has a voltage. Until the first energy report it is all on L1.
+func (s *Slave) GetPhaseCurrents() [3]int {
+	var currents [3]int
+	if s.phaseVolts == [3]int{} {
+		currents[0] = s.current
+		return currents
+	}
+	for phase, volts := range s.phaseVolts {
+		if volts > 0 {
+			currents[phase] = s.current
+		}
+	}
+	return currents
+}
+
+func (s *Slave) TimeSinceLastEnergyReport() time.Duration {
+	return time.Since(s.lastEnergyReport)
+}
+
+// Ask the slave for its meter readings if it is due. Only protocol 2 slaves know how to answer.
+func (s *Slave) RequestEnergy(masterAddress uint) {
+	if (s.protocol != twcMessage.ProtocolVersion2) || (time.Since(s.lastEnergyRequest) < EnergyRequestInterval) {
+		return
+	}
+	msg := twcMessage.New(s.port, s.listenMode)
+	msg.SetProtocolVersion(s.protocol)
+	msg.SendEnergyRequest(masterAddress, s.address)
+	s.lastEnergyRequest = time.Now()
+}
+
+// Record part of the VIN from a VIN report. Returns true if this completed the VIN.
+func (s *Slave) UpdateVIN(msg *twcMessage.TwcMessage) bool {
+	part := msg.GetVINPart()
+	if part < 0 {
+		return false
+	}
+	s.vinParts[part] = strings.TrimRight(msg.GetVINFragment(), "\x00")
+	s.lastHeartBeat = time.Now()
+	if s.vinWanted && (s.GetVIN() != "") {
+		s.vinWanted = false
+		return true
+	}
+	return false
+}
+
+// Return the VIN of the car plugged in or an empty string if we don't have all of it
+func (s *Slave) GetVIN() string {
+	for _, part := range s.vinParts {
+		if part == "" {
+			return ""
+		}
+	}
+	return strings.Join(s.vinParts[:], "")
+}
+
+// Ask the slave for the next missing part of the VIN if we are waiting for one. Only protocol 2 slaves know how to answer.
+func (s *Slave) RequestVIN(masterAddress uint) {
+	if !s.vinWanted || (s.protocol != twcMessage.ProtocolVersion2) || (time.Since(s.lastVINRequest) < VINRequestInterval) {
+		return
+	}
+	for part, fragment := range s.vinParts {
+		if fragment == "" {
+			msg := twcMessage.New(s.port, s.listenMode)
+			msg.SetProtocolVersion(s.protocol)
+			msg.SendVINRequest(masterAddress, s.address, part)
+			s.lastVINRequest = time.Now()
+			return
+		}
+	}
+}
+
 func (s *Slave) TimeSinceLastHeartbeat() time.Duration {
 	return time.Since(s.lastHeartBeat)
 }
@@ -148,21 +381,27 @@ func (s *Slave) SendMasterHeartbeat(masterAddress uint, listenMode bool) {
 	if masterAddress == 0 {
 		log.Panicln("Attempt to send hearbeat from a master address of 0! This can't be correct.")
 	}
+	// Protocol 2 chargers get the longer heartbeat layout and use command 09 to set the allowed current
+	msg.SetProtocolVersion(s.protocol)
+	setpointCommand := byte(MasterChangeSetpoint)
+	if s.protocol == twcMessage.ProtocolVersion2 {
+		setpointCommand = MasterLimitChargeCurrent
+	}
 	if s.setPoint != s.allowedValue {
-		if s.allowedValue >= 500 {
+		if s.allowedValue >= s.GetMinimumCurrent() {
 			// Tell the car to charge at the provided current
 			if (s.spikeTime.After(time.Now())) && (s.spikeAmps > 0) {
-				msg.SendMasterHeartbeat(masterAddress, s.address, MasterChangeSetpoint, 0, s.spikeAmps)
+				msg.SendMasterHeartbeat(masterAddress, s.address, setpointCommand, 0, s.spikeAmps)
 			} else {
 				s.spikeAmps = 0
-				msg.SendMasterHeartbeat(masterAddress, s.address, MasterChangeSetpoint, 0, s.allowedValue)
+				msg.SendMasterHeartbeat(masterAddress, s.address, setpointCommand, 0, s.allowedValue)
 			}
 			//			if listenMode {
 			//				fmt.Printf("Sending to %04x from %04x status = %02x Setpoint = %0.2f Current = %0.2f\n", s.address, masterAddress, MasterChangeSetpoint, float32(s.allowedValue) / 100, float32(s.allowedValue) / 100)
 			//			}
 		} else {
-			// Tell the car to stop charging as we cannot supply at least 5 amps
-			msg.SendMasterHeartbeat(masterAddress, s.GetAddress(), MasterChangeSetpoint, 0, 0)
+			// Tell the car to stop charging as we cannot supply its minimum current
+			msg.SendMasterHeartbeat(masterAddress, s.GetAddress(), setpointCommand, 0, 0)
 			//			if listenMode {
 			//				fmt.Printf("Sending to %04x from %04x status = %02x Setpoint = 0.0 Current = 0.0\n", s.GetAddress(), masterAddress, MasterChangeSetpoint)
 			//			}
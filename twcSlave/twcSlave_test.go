@@ -0,0 +1,23 @@
+package twcSlave
+
+import (
+	"TeslaChargeControl/twcMessage"
+	"testing"
+	"time"
+)
+
+// A slave we only see in the followed master's heartbeats must not time out
+func TestUpdateFromMaster(t *testing.T) {
+	s := New(0x1234, false, nil)
+	s.lastHeartBeat = time.Now().Add(-time.Minute)
+	msg := twcMessage.New(nil, false)
+	msg.PutStatus(MasterChangeSetpoint)
+	msg.PutSetPoint(1600)
+	s.UpdateFromMaster(&msg)
+	if s.GetAllowed() != 1600 {
+		t.Errorf("allowed %d after the master set 1600", s.GetAllowed())
+	}
+	if since := s.TimeSinceLastHeartbeat(); since > time.Second {
+		t.Errorf("%s since the last heartbeat after a master heartbeat", since)
+	}
+}